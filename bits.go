@@ -47,6 +47,21 @@ func (br *BitReader) ReadAt(pos, bit int64) (p uint64, err error) {
 	return
 }
 
+// bitsAt reads n bits at bit pos of b, like BitReader.ReadAt on a buffer.
+func bitsAt(b []byte, pos int64, n uint) (p uint64) {
+	for n > 0 {
+		off := uint(pos % 8)
+		take := 8 - off
+		if take > n {
+			take = n
+		}
+		p = p << take | uint64(b[pos / 8]) >> (8 - off - take) & (1 << take - 1)
+		pos += int64(take)
+		n -= take
+	}
+	return
+}
+
 type BitWriter struct {
 	w   io.Writer
 	buf []byte
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// Block compressed positions: the stream head (posBits, count) is followed
+// by a directory with an entry per blockSize entries, then the blocks. A
+// directory entry is the bit offset of its block past the directory (48
+// bits), the smallest position of the block (posBits), the width of the
+// packed values (7 bits) and whether they are gaps (1 bit). Values are the
+// position less the smallest one or, when the block ascends, less the one
+// before; each is followed by its tag.
+const blockSize = 128
+
+func blockDirBits(posBits uint) uint {
+	return 48 + posBits + 8
+}
+
+type blockHead struct {
+	offset int64
+	base   int64
+	width  uint
+	gaps   bool
+}
+
+// blockOf packs entries [start, end) in the smaller of both ways.
+func blockOf(index positionList, start, end int) (bh blockHead) {
+	low, high := index.GetPos(start), index.GetPos(start)
+	var gap int64
+	ascending := true
+	for i := start + 1; i < end; i++ {
+		pos := index.GetPos(i)
+		if pos < low { low = pos }
+		if pos > high { high = pos }
+		if d := pos - index.GetPos(i - 1); d < 0 {
+			ascending = false
+		} else if d > gap {
+			gap = d
+		}
+	}
+	bh.base = low
+	bh.width = bitsFor(high - low)
+	if ascending && bitsFor(gap) < bh.width {
+		bh.width, bh.gaps = bitsFor(gap), true
+	}
+	return
+}
+
+// bitsFor returns the bits needed to hold v, 0 for 0.
+func bitsFor(v int64) uint {
+	bits := uint(0)
+	for ; v > 0; v >>= 1 {
+		bits++
+	}
+	return bits
+}
+
+// DoWriteBlocks is DoWrite with block compressed positions.
+func (iw *indexWriter) DoWriteBlocks(ctx context.Context, file io.Writer, index positionList, posBits, tagBits uint) error {
+	iw.entryTotal = index.Len()
+	tagged, _ := index.(taggedList)
+	bw := NewBitWriter(file)
+	if err := bw.Write(uint64(posBits), 8); err != nil {
+		return err
+	}
+	if err := bw.Write(uint64(index.Len()), 56); err != nil {
+		return err
+	}
+	var heads []blockHead
+	var offset int64
+	for start := 0; start < index.Len(); start += blockSize {
+		end := min(start + blockSize, index.Len())
+		bh := blockOf(index, start, end)
+		bh.offset = offset
+		offset += int64(end - start) * int64(bh.width + tagBits)
+		heads = append(heads, bh)
+	}
+	for _, bh := range heads {
+		flags := uint64(bh.width) << 1
+		if bh.gaps {
+			flags |= 1
+		}
+		if err := bw.Write(uint64(bh.offset), 48); err != nil {
+			return err
+		}
+		if err := bw.Write(uint64(bh.base), posBits); err != nil {
+			return err
+		}
+		if err := bw.Write(flags, 8); err != nil {
+			return err
+		}
+	}
+	for b, bh := range heads {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		prev := bh.base
+		for i := b * blockSize; i < index.Len() && i < (b + 1) * blockSize; i++ {
+			pos := index.GetPos(i)
+			if err := bw.Write(uint64(pos - prev), bh.width); err != nil {
+				return err
+			}
+			if bh.gaps {
+				prev = pos
+			}
+			if tagBits > 0 {
+				if err := bw.Write(uint64(tagged.GetTag(i)), tagBits); err != nil {
+					return err
+				}
+			}
+			atomic.StoreInt64(&iw.entryCount, int64(i + 1))
+		}
+	}
+	return bw.Close()
+}
+
+// blockPositions reads a block compressed stream, keeping the last block
+// decoded since entries are mostly read in runs.
+type blockPositions struct {
+	ir      *IndexReader
+	dirBits int64
+	data    int64
+
+	block int64
+	pos   []int64
+	tags  []int
+	buf   []byte
+}
+
+func newBlockPositions(ir *IndexReader) *blockPositions {
+	return &blockPositions{
+		ir:      ir,
+		dirBits: int64(blockDirBits(uint(ir.posBits))),
+		data:    (ir.count + blockSize - 1) / blockSize * int64(blockDirBits(uint(ir.posBits))),
+		block:   -1,
+	}
+}
+
+func (bp *blockPositions) head(b int64) (bh blockHead, err error) {
+	at := b * bp.dirBits
+	v, err := bp.ir.br.ReadAt(at, 48)
+	if err != nil {
+		return
+	}
+	bh.offset = int64(v)
+	v, err = bp.ir.br.ReadAt(at + 48, bp.ir.posBits)
+	if err != nil {
+		return
+	}
+	bh.base = int64(v)
+	v, err = bp.ir.br.ReadAt(at + 48 + bp.ir.posBits, 8)
+	bh.width, bh.gaps = uint(v >> 1), v & 1 == 1
+	return
+}
+
+// load decodes block b.
+func (bp *blockPositions) load(b int64) error {
+	if b == bp.block {
+		return nil
+	}
+	bh, err := bp.head(b)
+	if err != nil {
+		return err
+	}
+	n := min64(blockSize, bp.ir.count - b * blockSize)
+	bits := int64(bh.width) + bp.ir.tagBits
+	start := bp.data + bh.offset
+	end := start + n * bits
+	first := start / 8
+	if need := int((end + 7) / 8 - first); cap(bp.buf) < need {
+		bp.buf = make([]byte, need)
+	} else {
+		bp.buf = bp.buf[0:need]
+	}
+	if _, err = bp.ir.fidx.ReadAt(bp.buf, bp.ir.br.Base + first); err != nil {
+		return err
+	}
+	bp.pos, bp.tags = bp.pos[0:0], bp.tags[0:0]
+	prev := bh.base
+	for k := int64(0); k < n; k++ {
+		at := start - first * 8 + k * bits
+		pos := prev + int64(bitsAt(bp.buf, at, bh.width))
+		if bh.gaps {
+			prev = pos
+		}
+		bp.pos = append(bp.pos, pos)
+		bp.tags = append(bp.tags, int(bitsAt(bp.buf, at + int64(bh.width), uint(bp.ir.tagBits))))
+	}
+	bp.block = b
+	return nil
+}
+
+func (bp *blockPositions) Pos(i int64) (int64, error) {
+	if err := bp.load(i / blockSize); err != nil {
+		return 0, err
+	}
+	return bp.pos[i % blockSize], nil
+}
+func (bp *blockPositions) Tag(i int64) (int, error) {
+	if err := bp.load(i / blockSize); err != nil {
+		return 0, err
+	}
+	return bp.tags[i % blockSize], nil
+}
+
+// end returns the bit offset past the last block.
+func (bp *blockPositions) end() (int64, error) {
+	if bp.ir.count == 0 {
+		return 0, nil
+	}
+	last := (bp.ir.count - 1) / blockSize
+	bh, err := bp.head(last)
+	if err != nil {
+		return 0, err
+	}
+	n := bp.ir.count - last * blockSize
+	return bp.data + bh.offset + n * (int64(bh.width) + bp.ir.tagBits), nil
+}
+
+// positionRuns orders the entries [start, end) of an index by position.
+type positionRuns struct {
+	*Index
+	start int
+	end   int
+}
+
+func (pr positionRuns) Len() int           { return pr.end - pr.start }
+func (pr positionRuns) Less(i, j int) bool { return pr.GetPos(pr.start + i) < pr.GetPos(pr.start + j) }
+func (pr positionRuns) Swap(i, j int)      { pr.Index.Swap(pr.start + i, pr.start + j) }
+
+// sortRuns puts the entries of each term of dict in position order.
+func sortRuns(index *Index, dict []dictEntry) {
+	for k, e := range dict {
+		end := index.Len()
+		if k + 1 < len(dict) {
+			end = dict[k + 1].start
+		}
+		if end - e.start > 1 {
+			sort.Sort(positionRuns{ index, e.start, end })
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+type testPositions struct {
+	pos  []int64
+	tags []int
+}
+
+func (tp testPositions) Len() int           { return len(tp.pos) }
+func (tp testPositions) GetPos(i int) int64 { return tp.pos[i] }
+func (tp testPositions) GetTag(i int) int   { return tp.tags[i] }
+
+// Positions and tags written in blocks read back the same, whatever the
+// width their blocks pack them in.
+func TestBlockRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	fill := func(n int, fn func(i int) int64) []int64 {
+		pos := make([]int64, n)
+		for i := range pos {
+			pos[i] = fn(i)
+		}
+		return pos
+	}
+	cases := []struct {
+		name    string
+		posBits uint
+		pos     []int64
+	}{
+		{ "empty", 8, nil },
+		{ "one", 8, []int64{ 200 } },
+		{ "zero", 1, fill(blockSize, func(i int) int64 { return 0 }) },
+		// a block of equal positions packs them in 0 bits
+		{ "equal", 20, fill(blockSize * 2 + 1, func(i int) int64 { return 12345 }) },
+		{ "ascending", 24, fill(blockSize * 3, func(i int) int64 { return int64(i * 3 + i % 2) }) },
+		{ "descending", 24, fill(blockSize + 5, func(i int) int64 { return int64(1000000 - i * 7) }) },
+		{ "runs", 32, fill(blockSize * 2 - 1, func(i int) int64 { return int64(i % 10 * 100000 + i) }) },
+		{ "random", 40, fill(1000, func(i int) int64 { return rnd.Int63n(1 << 40) }) },
+		// values as wide as the stream allows
+		{ "widest", 56, fill(blockSize + 1, func(i int) int64 { return int64(i % 2) << 55 | int64(i) }) },
+		{ "widest gaps", 56, fill(blockSize, func(i int) int64 { return int64(i) << 48 }) },
+	}
+
+	dir := t.TempDir()
+	for _, c := range cases {
+		for _, tagBits := range []uint{ 0, 1, 5 } {
+			tp := testPositions{ c.pos, make([]int, len(c.pos)) }
+			for i := range tp.tags {
+				tp.tags[i] = rnd.Intn(1 << tagBits)
+			}
+			name := path.Join(dir, "blocks")
+			f, err := os.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = new(indexWriter).DoWriteBlocks(context.Background(), f, tp, c.posBits, tagBits); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			f, err = os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ir := &IndexReader{
+				ctx:     context.Background(),
+				fidx:    f,
+				br:      NewBitReader(f),
+				posBits: int64(c.posBits),
+				tagBits: int64(tagBits),
+				count:   int64(len(c.pos)),
+			}
+			ir.br.Base = 8
+			bp := newBlockPositions(ir)
+			// visit the blocks out of order so each is decoded afresh
+			for _, i := range rnd.Perm(len(c.pos)) {
+				pos, err := bp.Pos(int64(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				tag, err := bp.Tag(int64(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pos != c.pos[i] || tag != tp.tags[i] {
+					t.Fatalf("%s, %d tag bits: entry %d is %d/%d, want %d/%d", c.name, tagBits, i, pos, tag, c.pos[i], tp.tags[i])
+				}
+			}
+			end, err := bp.end()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi, _ := f.Stat(); fi.Size() != 8 + (end + 7) / 8 {
+				t.Errorf("%s, %d tag bits: %d bytes written, stream ends at bit %d", c.name, tagBits, fi.Size(), end)
+			}
+			f.Close()
+		}
+	}
+}
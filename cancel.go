@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+)
+
+// ctxReader fails reads with the context's error once it is done, so long
+// scans stop at their next buffer fill.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// sortCanceled carries the context's error out of sort.Sort.
+type sortCanceled struct {
+	err error
+}
+
+// cancelableSort checks the context every 64K comparisons.
+type cancelableSort struct {
+	sort.Interface
+	ctx context.Context
+	n   int
+}
+
+func (cs *cancelableSort) Less(i, j int) bool {
+	if cs.n++; cs.n & 0xFFFF == 0 {
+		if err := cs.ctx.Err(); err != nil {
+			panic(sortCanceled{ err })
+		}
+	}
+	return cs.Interface.Less(i, j)
+}
+
+// sortContext is sort.Sort giving up with the context's error once it is
+// done, leaving data partly sorted.
+func sortContext(ctx context.Context, data sort.Interface) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			sc, ok := r.(sortCanceled)
+			if !ok {
+				panic(r)
+			}
+			err = sc.err
+		}
+	}()
+	sort.Sort(&cancelableSort{ Interface: data, ctx: ctx })
+	return ctx.Err()
+}
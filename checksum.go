@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// sumBlockSize is the span of the position stream each block checksum
+// covers.
+const sumBlockSize = 64 * 1024
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// indexSums is the "SUMS" section, written last: CRC32C checksums of the
+// head (magic, file list and meta), of the position stream in blocks, and of
+// the sections between the stream and it.
+type indexSums struct {
+	head   uint32
+	tail   uint32
+	blocks []uint32
+}
+
+// computeSums checksums an index whose position stream is [streamStart,
+// streamEnd) and whose sections end at end.
+func computeSums(r io.ReaderAt, streamStart, streamEnd, end int64) (*indexSums, error) {
+	sums := new(indexSums)
+	var err error
+	if sums.head, err = crcRange(r, 0, streamStart); err != nil {
+		return nil, err
+	}
+	for off := streamStart; off < streamEnd; off += sumBlockSize {
+		crc, err := crcRange(r, off, min64(off + sumBlockSize, streamEnd))
+		if err != nil {
+			return nil, err
+		}
+		sums.blocks = append(sums.blocks, crc)
+	}
+	if sums.tail, err = crcRange(r, streamEnd, end); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+func crcRange(r io.ReaderAt, start, end int64) (uint32, error) {
+	h := crc32.New(castagnoli)
+	_, err := io.Copy(h, io.NewSectionReader(r, start, end - start))
+	return h.Sum32(), err
+}
+
+// Dump encodes the sums: head, tail and block count, then the blocks, all
+// 32-bit.
+func (sums *indexSums) Dump() []byte {
+	buf := make([]byte, 12 + 4 * len(sums.blocks))
+	binary.BigEndian.PutUint32(buf[0:], sums.head)
+	binary.BigEndian.PutUint32(buf[4:], sums.tail)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(sums.blocks)))
+	for i, crc := range sums.blocks {
+		binary.BigEndian.PutUint32(buf[12 + 4 * i:], crc)
+	}
+	return buf
+}
+
+var errBadSums = errors.New("bad checksum section")
+
+func readSums(data []byte) (*indexSums, error) {
+	if len(data) < 12 {
+		return nil, errBadSums
+	}
+	sums := &indexSums{
+		head: binary.BigEndian.Uint32(data[0:]),
+		tail: binary.BigEndian.Uint32(data[4:]),
+	}
+	n := int(binary.BigEndian.Uint32(data[8:]))
+	if len(data) != 12 + 4 * n {
+		return nil, errBadSums
+	}
+	for i := 0; i < n; i++ {
+		sums.blocks = append(sums.blocks, binary.BigEndian.Uint32(data[12 + 4 * i:]))
+	}
+	return sums, nil
+}
+
+// writeSums appends the SUMS section to an index written up to its current
+// offset.
+func writeSums(f *os.File, streamStart, streamEnd int64) error {
+	end, err := f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	sums, err := computeSums(f, streamStart, streamEnd, end)
+	if err != nil {
+		return err
+	}
+	return writeSection(f, "SUMS", sums.Dump())
+}
+
+// streamEnd is where the position stream of the index ends.
+func (ir *IndexReader) streamEnd() int64 {
+	return ir.br.Base + (ir.bits + 7) / 8
+}
+
+// verifyIndex checks the checksums of an index, that its terms are in order,
+// that every entry lies inside its file and holds its term, and that the
+// skip samples, inline prefixes and reversed entries agree with the entries,
+// returning the number of problems found.
+func verifyIndex(ctx context.Context, base, index string) (problems int) {
+	ir, err := OpenIndex(ctx, base, index)
+	if handleErr(err) { return }
+	defer ir.Close()
+
+	problem := func(format string, v ...interface{}) {
+		problems++
+		if problems <= 20 {
+			printf("  " + format + "\n", v...)
+		}
+	}
+
+	printf("Checksums ...\n")
+	if sec, ok := ir.sections["SUMS"]; ok {
+		data := make([]byte, sec.length)
+		_, err = ir.fidx.ReadAt(data, sec.offset)
+		if handleErr(err) { return }
+		want, err := readSums(data)
+		if handleErr(err) { return }
+		got, err := computeSums(ir.fidx, ir.br.Base - 8, ir.streamEnd(), sec.offset - 12)
+		if handleErr(err) { return }
+		if got.head != want.head {
+			problem("head checksum mismatch")
+		}
+		if got.tail != want.tail {
+			problem("section checksum mismatch")
+		}
+		if len(got.blocks) != len(want.blocks) {
+			problem("%d position blocks, expected %d", len(got.blocks), len(want.blocks))
+		}
+		for i := 0; i < len(got.blocks) && i < len(want.blocks); i++ {
+			if got.blocks[i] != want.blocks[i] {
+				problem("position block %d checksum mismatch", i)
+			}
+		}
+	} else {
+		printf("  no checksums\n")
+	}
+
+	compare := bytes.Compare
+	if ir.meta["order"] == "numeric" {
+		compare = compareNumeric
+	}
+	inFile := func(kind string, i, offset int64, length int) bool {
+		if offset < 0 || offset >= ir.f.Size() {
+			problem("%s %d at %d is past the files", kind, i, offset)
+			return false
+		}
+		file := ir.f.OffsetIndex(offset)
+		if offset + int64(length) > ir.f.FileOffset(file) + ir.f.FileSize(file) {
+			problem("%s %d at %d crosses the end of its file", kind, i, offset)
+			return false
+		}
+		return true
+	}
+
+	// samples and prefixes are checked against the keys the entry loops read
+	skip, err := ir.Skip()
+	if err != nil {
+		problem("skip table: %v", err)
+		skip = nil
+	}
+	checkSample := func(k, index int64, key []byte, whole bool) {
+		if skip == nil || k % ir.skipEvery != 0 {
+			return
+		}
+		sp := skip[k / ir.skipEvery]
+		key = key[0:min(len(key), skipPrefix)]
+		if sp.index != index || sp.whole != whole || !bytes.Equal(sp.prefix, key) {
+			problem("skip sample %d (%d %q) does not match %d %q", k / ir.skipEvery, sp.index, sp.prefix, index, key)
+		}
+	}
+	pref, hasPref := ir.sections["PREF"]
+	inline := 0
+	if hasPref {
+		head := make([]byte, 4)
+		_, err = ir.fidx.ReadAt(head, pref.offset)
+		if handleErr(err) { return }
+		inline = int(binary.BigEndian.Uint32(head))
+		if inline < 1 || inline > inlineMax || pref.length != 4 + ir.count * int64(inline + 1) {
+			problem("prefix section of %d bytes with %d byte prefixes", pref.length, inline)
+			hasPref = false
+		}
+	}
+	rec := make([]byte, inline + 1)
+	checkPrefix := func(i int64, key []byte, whole bool) error {
+		if !hasPref {
+			return nil
+		}
+		if _, err := ir.fidx.ReadAt(rec, pref.offset + 4 + i * int64(inline + 1)); err != nil {
+			return err
+		}
+		length := min(int(rec[0] & 0x7F), inline)
+		key = key[0:min(len(key), inline)]
+		if length != len(key) || (rec[0] & 0x80 != 0) != whole || !bytes.Equal(rec[1 : 1 + length], key) {
+			problem("entry %d prefix %q does not match %q", i, rec[1 : 1 + length], key)
+		}
+		return nil
+	}
+	// entries and reversed entries must sum to the same over their term and
+	// position, whatever their order
+	h := fnv.New64a()
+	entrySum := func(term []byte, offset int64) uint64 {
+		h.Reset()
+		h.Write(term)
+		return h.Sum64() + uint64(offset) * 0x9E3779B97F4A7C15
+	}
+	var sum uint64
+
+	printf("Entries ...\n")
+	td, err := ir.Dict()
+	switch {
+	case err == nil:
+		if skip != nil && (ir.skipEvery < 1 || int64(len(skip)) != (td.Len() + ir.skipEvery - 1) / ir.skipEvery) {
+			problem("%d skip samples every %d of %d terms", len(skip), ir.skipEvery, td.Len())
+			skip = nil
+		}
+		var prev []byte
+		for k := int64(0); k < td.Len(); k++ {
+			// the term is read from its first entry, check that first
+			start, length, err := td.Entry(k)
+			if handleErr(err) { return }
+			end, err := ir.termStart(k + 1)
+			if handleErr(err) { return }
+			if start >= end || end > ir.count {
+				problem("term %d has entries [%d, %d) of %d", k, start, end, ir.count)
+				prev = nil
+				continue
+			}
+			offset, err := ir.Pos(start)
+			if handleErr(err) { return }
+			if !inFile("entry", start, offset, length) {
+				prev = nil
+				continue
+			}
+			term, _, _, err := ir.Term(k)
+			if handleErr(err) { return }
+			if prev != nil && compare(prev, term) >= 0 {
+				problem("term %d %q is not after %q", k, term, prev)
+			}
+			checkSample(k, start, term, len(term) <= skipPrefix)
+			for i := start; i < end; i++ {
+				if handleErr(checkPrefix(i, term, len(term) <= inline)) { return }
+				offset, err := ir.Pos(i)
+				if handleErr(err) { return }
+				sum += entrySum(term, offset)
+				if !inFile("entry", i, offset, len(term)) {
+					continue
+				}
+				str, err := ir.f.ReadAt(offset, ir.buf[0:len(term)])
+				if handleErr(err) { return }
+				if !bytes.Equal(str, term) {
+					problem("entry %d %q does not hold term %q", i, str, term)
+				}
+			}
+			prev = term
+		}
+	case err == errNoDict && ir.meta["mode"] == "suffix":
+		if skip != nil && (ir.skipEvery < 1 || int64(len(skip)) != (ir.count + ir.skipEvery - 1) / ir.skipEvery) {
+			problem("%d skip samples every %d of %d entries", len(skip), ir.skipEvery, ir.count)
+			skip = nil
+		}
+		var prev []byte
+		for i := int64(0); i < ir.count; i++ {
+			offset, err := ir.Pos(i)
+			if handleErr(err) { return }
+			if !inFile("entry", i, offset, 1) {
+				prev = nil
+				continue
+			}
+			str, err := ir.f.ReadAt(offset, ir.buf)
+			if handleErr(err) { return }
+			str = str[0:lineEnd(str, 0)]
+			if prev != nil && bytes.Compare(prev, str) > 0 {
+				problem("entry %d is not in order", i)
+			}
+			checkSample(i, i, str, len(str) < skipPrefix)
+			if handleErr(checkPrefix(i, str, len(str) < inline)) { return }
+			prev = append(prev[0:0], str...)
+		}
+	case err == errNoDict:
+		printf("  no dictionary, order not checked\n")
+		for i := int64(0); i < ir.count; i++ {
+			offset, err := ir.Pos(i)
+			if handleErr(err) { return }
+			inFile("entry", i, offset, 1)
+		}
+	default:
+		handleErr(err)
+		return
+	}
+
+	if _, ok := ir.sections["RVRS"]; ok && td != nil {
+		printf("Reversed ...\n")
+		rv, err := ir.Reversed()
+		if handleErr(err) { return }
+		if rv.count != ir.count {
+			problem("%d reversed entries, expected %d", rv.count, ir.count)
+		}
+		var prev []byte
+		var rsum uint64
+		for i := int64(0); i < rv.count; i++ {
+			offset, length, _, err := rv.Entry(i, ir.tagBits)
+			if handleErr(err) { return }
+			if !inFile("reversed entry", i, offset, length) {
+				prev = nil
+				continue
+			}
+			str, err := ir.f.ReadAt(offset, ir.buf[0:min(length, len(ir.buf))])
+			if handleErr(err) { return }
+			if prev != nil && compareReversed(prev, str) > 0 {
+				problem("reversed entry %d is not in order", i)
+			}
+			rsum += entrySum(str, offset)
+			prev = append(prev[0:0], str...)
+		}
+		if rv.count == ir.count && rsum != sum {
+			problem("reversed entries do not match the entries")
+		}
+	}
+
+	if problems > 0 {
+		printf("Verify failed: %d problems\n", problems)
+		return
+	}
+	printf("Verify OK: %d entries\n", ir.count)
+	return
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Positions pointing past the files are problems verify reports, not panics,
+// and searches fail on them with an error.
+func TestVerifyCorruptPositions(t *testing.T) {
+	dir := t.TempDir()
+	var sb strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, "w%d\n", i % 37)
+	}
+	if err := os.WriteFile(path.Join(dir, "a.txt"), []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	index := path.Join(dir, ".index")
+	ws, err := NewWordSpliter(`(\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeIndex(ctx, dir, index, ws)
+	if n := verifyIndex(ctx, dir, index); n != 0 {
+		t.Fatalf("verify found %d problems in a good index", n)
+	}
+
+	ir, err := OpenIndex(ctx, dir, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := ir.br.Base, ir.streamEnd()
+	ir.Close()
+	data, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := start; i < end; i++ {
+		data[i] = 0xff
+	}
+	if err := os.WriteFile(index, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := verifyIndex(ctx, dir, index); n == 0 {
+		t.Fatal("verify found no problems in a corrupt index")
+	}
+	ir, err = OpenIndex(ctx, dir, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	if _, err := ir.Lookup([]byte("w7")); err == nil {
+		t.Error("lookup on a corrupt index did not fail")
+	}
+}
+
+// A damaged record in the skip, prefix or reversed section is found by
+// checking it against the entries, not only by the section checksum.
+func TestVerifySections(t *testing.T) {
+	dir := t.TempDir()
+	var sb strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, "w%d\n", i % 37)
+	}
+	if err := os.WriteFile(path.Join(dir, "a.txt"), []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	good := path.Join(dir, ".good")
+	ws, err := NewWordSpliter(`(\w+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Meta["inline"] = "4"
+	ws.Meta["reverse"] = "1"
+	makeIndex(ctx, dir, good, ws)
+	if n := verifyIndex(ctx, dir, good); n != 0 {
+		t.Fatalf("verify found %d problems in a good index", n)
+	}
+	ir, err := OpenIndex(ctx, dir, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := ir.sections
+	ir.Close()
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the low byte of the first sample's entry, the first byte of the first
+	// prefix and the top byte of the first reversed position
+	for tag, at := range map[string]int64{ "SKIP": 8 + 7, "PREF": 4 + 1, "RVRS": 8 } {
+		sec, ok := sections[tag]
+		if !ok {
+			t.Fatalf("no %s section", tag)
+		}
+		bad := append([]byte(nil), data...)
+		bad[sec.offset + at] ^= 0x40
+		index := path.Join(dir, ".bad")
+		if err := os.WriteFile(index, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// one problem is the section checksum
+		if n := verifyIndex(ctx, dir, index); n < 2 {
+			t.Errorf("%s: verify found %d problems", tag, n)
+		}
+	}
+}
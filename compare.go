@@ -0,0 +1,75 @@
+package main
+
+// compareNumeric orders like bytes.Compare except that digit runs compare by
+// value, so "9" < "10" and "007" == "7" up to a final tie break on length.
+func compareNumeric(a, b []byte) int {
+	return numericOrder(a, b, false)
+}
+
+// comparePrefixNumeric is compareNumeric but returns 0 once q is used up,
+// the digit run q ends in must still be matched whole.
+func comparePrefixNumeric(term, q []byte) int {
+	return numericOrder(term, q, true)
+}
+
+func numericOrder(a, b []byte, prefix bool) int {
+	tie := 0
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				if a[i] < b[j] {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+			continue
+		}
+		za, zb := i, j
+		for za < len(a) && a[za] == '0' {
+			za++
+		}
+		for zb < len(b) && b[zb] == '0' {
+			zb++
+		}
+		ea, eb := za, zb
+		for ea < len(a) && isDigit(a[ea]) {
+			ea++
+		}
+		for eb < len(b) && isDigit(b[eb]) {
+			eb++
+		}
+		if ea - za != eb - zb {
+			if ea - za < eb - zb {
+				return -1
+			}
+			return 1
+		}
+		for k := 0; k < ea - za; k++ {
+			if a[za+k] != b[zb+k] {
+				if a[za+k] < b[zb+k] {
+					return -1
+				}
+				return 1
+			}
+		}
+		if tie == 0 && ea - i != eb - j {
+			tie = 1
+			if ea - i < eb - j {
+				tie = -1
+			}
+		}
+		i, j = ea, eb
+	}
+	switch {
+	case j == len(b) && prefix:
+		return 0
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	}
+	return tie
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCompareNumeric(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{ "", "", 0 },
+		{ "", "0", -1 },
+		{ "7", "7", 0 },
+		{ "9", "10", -1 },
+		{ "10", "9", 1 },
+		{ "a2b", "a10b", -1 },
+		{ "10a", "9b", 1 },
+		{ "1.5", "1.10", -1 },
+		// equal values tie break on the length of the digit run
+		{ "7", "007", -1 },
+		{ "007", "7", 1 },
+		{ "0", "00", -1 },
+		{ "id7x", "id007x", -1 },
+		// later bytes decide before the tie break does
+		{ "id007a", "id7b", -1 },
+		{ "x09z", "x9y", 1 },
+		{ "a", "a1", -1 },
+		{ "abc", "abd", -1 },
+		{ "Z1", "a1", -1 },
+		{ "1a", "a", -1 },
+	} {
+		if got := compareNumeric([]byte(c.a), []byte(c.b)); got != c.want {
+			t.Errorf("compareNumeric(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestComparePrefixNumeric(t *testing.T) {
+	for _, c := range []struct {
+		term, q string
+		want    int
+	}{
+		{ "id7", "id7", 0 },
+		{ "id007", "id7", 0 },
+		{ "id007x", "id7", 0 },
+		{ "id7", "id", 0 },
+		{ "id7", "", 0 },
+		// the digit run q ends in is matched whole
+		{ "id70", "id7", 1 },
+		{ "id6", "id7", -1 },
+		{ "id", "id7", -1 },
+		{ "ie", "id7", 1 },
+	} {
+		if got := comparePrefixNumeric([]byte(c.term), []byte(c.q)); got != c.want {
+			t.Errorf("comparePrefixNumeric(%q, %q) = %d, want %d", c.term, c.q, got, c.want)
+		}
+	}
+}
+
+// compareNumeric must be a total order for sorting: 0 only for equal
+// strings, antisymmetric and transitive.
+func TestCompareNumericOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const alphabet = "0019ab."
+	words := make([][]byte, 60)
+	for i := range words {
+		w := make([]byte, rnd.Intn(7))
+		for k := range w {
+			w[k] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		words[i] = w
+	}
+	for _, a := range words {
+		for _, b := range words {
+			ab := compareNumeric(a, b)
+			if ab != -compareNumeric(b, a) {
+				t.Fatalf("%q and %q compare %d both ways", a, b, ab)
+			}
+			if (ab == 0) != (string(a) == string(b)) {
+				t.Fatalf("%q and %q compare %d", a, b, ab)
+			}
+			for _, c := range words {
+				if ab <= 0 && compareNumeric(b, c) <= 0 && compareNumeric(a, c) > 0 {
+					t.Fatalf("%q <= %q <= %q but %q > %q", a, b, c, a, c)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// csvFormat picks the columns to index from CSV/TSV records. Every file
+// starts with a header record; columns are given by header name or by
+// 1-based number, and the position in the list is the tag stored per entry.
+type csvFormat struct {
+	comma   byte
+	columns []string
+}
+
+var errNoColumns = errors.New("no columns given")
+
+func NewFieldSpliter(comma byte, columns string) (*WordSpliter, error) {
+	cf := &csvFormat{ comma: comma }
+	for _, col := range strings.Split(columns, ",") {
+		col = strings.TrimSpace(col)
+		if col != "" {
+			cf.columns = append(cf.columns, col)
+		}
+	}
+	if len(cf.columns) == 0 {
+		return nil, errNoColumns
+	}
+	ws := new(WordSpliter)
+	ws.csv = cf
+	ws.TagBits = tagBitsFor(len(cf.columns))
+	ws.Meta = indexMeta{
+		"format":  "csv",
+		"columns": strings.Join(cf.columns, ","),
+		"tagbits": strconv.Itoa(int(ws.TagBits)),
+	}
+	if comma == '\t' {
+		ws.Meta["format"] = "tsv"
+	}
+	return ws, nil
+}
+func tagBitsFor(n int) uint {
+	bits := uint(1)
+	for ; 1 << bits < n; bits++ { }
+	return bits
+}
+
+// tags maps the fields of a header record to column tags.
+func (cf *csvFormat) tags(record []byte, header []fieldSpan) map[int]int {
+	tags := make(map[int]int, len(cf.columns))
+	for tag, col := range cf.columns {
+		if n, err := strconv.Atoi(col); err == nil {
+			tags[n - 1] = tag
+			continue
+		}
+		for i, name := range header {
+			if string(record[name.start : name.end]) == col {
+				tags[i] = tag
+				break
+			}
+		}
+	}
+	return tags
+}
+
+type fieldSpan struct {
+	start, end int
+}
+
+// readRecord reads one record into buf, it may span lines inside quoted
+// fields. Field spans index buf and exclude the quotes.
+func readRecord(br *bufio.Reader, comma byte, buf []byte, fields []fieldSpan) ([]byte, []fieldSpan, error) {
+	start := 0
+	quoted, inQuote := false, false
+	quoteEnd := 0
+	field := func(end int) {
+		if quoted {
+			fields = append(fields, fieldSpan{ start + 1, quoteEnd })
+		} else {
+			fields = append(fields, fieldSpan{ start, end })
+		}
+		quoted = false
+	}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if len(buf) > 0 {
+				field(len(buf))
+			}
+			return buf, fields, err
+		}
+		pos := len(buf)
+		buf = append(buf, c)
+		if inQuote {
+			if c == '"' {
+				next, err := br.Peek(1)
+				if err == nil && next[0] == '"' {
+					br.ReadByte()
+					buf = append(buf, '"')
+					continue
+				}
+				inQuote = false
+				quoteEnd = pos
+			}
+			continue
+		}
+		switch {
+		case c == '"' && pos == start:
+			inQuote, quoted = true, true
+		case c == comma:
+			field(pos)
+			start = pos + 1
+		case c == '\n':
+			end := pos
+			if end > start && buf[end-1] == '\r' {
+				end--
+			}
+			field(end)
+			return buf, fields, nil
+		}
+	}
+}
+
+func (ws *wordSpliteWorker) scanRecords(r io.Reader, emit func(pos int64, length, tag int)) error {
+	br := bufio.NewReader(r)
+	ws.wordSpliterStats = wordSpliterStats{}
+	ws.progress.Store(ws.wordSpliterStats)
+	offset := ws.offset
+	var record []byte
+	var fields []fieldSpan
+	var tags map[int]int
+	for records := 1; ; records++ {
+		var err error
+		record, fields, err = readRecord(br, ws.csv.comma, record[0:0], fields[0:0])
+		ws.byteCount += int64(len(record))
+		if tags == nil {
+			tags = ws.csv.tags(record, fields)
+		} else {
+			for i, fld := range fields {
+				tag, ok := tags[i]
+				if ok && fld.end > fld.start {
+					emit(offset + int64(fld.start), fld.end - fld.start, tag)
+				}
+			}
+		}
+		offset += int64(len(record))
+		if records % 1024 == 0 {
+			ws.progress.Store(ws.wordSpliterStats)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Sections follow the position stream, each a 4 byte tag, a 64-bit length
+// and the data.
+type indexSection struct {
+	offset, length int64
+}
+
+func writeSection(w io.Writer, tag string, data []byte) error {
+	head := make([]byte, 12)
+	copy(head, tag)
+	binary.BigEndian.PutUint64(head[4:], uint64(len(data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (ir *IndexReader) readSections() error {
+	ir.sections = make(map[string]indexSection)
+	offset := ir.streamEnd()
+	head := make([]byte, 12)
+	for {
+		_, err := ir.fidx.ReadAt(head, offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint64(head[4:]))
+		ir.sections[string(head[0:4])] = indexSection{ offset + 12, length }
+		offset += 12 + length
+	}
+}
+
+// dictEntry is a distinct term: the first of its entries and its length.
+type dictEntry struct {
+	start  int
+	length int
+}
+
+// BuildDict collapses runs of equal terms in the sorted index.
+func BuildDict(index *Index) (dict []dictEntry, wordMax int) {
+	var last, term []byte
+	for i := 0; i < index.Len(); i++ {
+		term = index.read(i, term)
+		if i == 0 || !bytes.Equal(term, last) {
+			dict = append(dict, dictEntry{ i, len(term) })
+			if len(term) > wordMax { wordMax = len(term) }
+		}
+		last, term = term, last
+	}
+	return
+}
+
+// DumpDict encodes the dictionary: 8 bits each for the widths of start and
+// length, 48 bits of count, then the entries.
+func DumpDict(dict []dictEntry, entryCount, wordMax int) []byte {
+	startBits := tagBitsFor(entryCount)
+	lenBits := tagBitsFor(wordMax + 1)
+	buf := new(bytes.Buffer)
+	bw := NewBitWriter(buf)
+	bw.Write(uint64(startBits), 8)
+	bw.Write(uint64(lenBits), 8)
+	bw.Write(uint64(len(dict)), 48)
+	for _, e := range dict {
+		bw.Write(uint64(e.start), startBits)
+		bw.Write(uint64(e.length), lenBits)
+	}
+	bw.Close()
+	return buf.Bytes()
+}
+
+var errNoDict = errors.New("index has no term dictionary, rebuild it")
+
+type termDict struct {
+	br        *BitReader
+	startBits int64
+	lenBits   int64
+	count     int64
+}
+
+func (ir *IndexReader) Dict() (*termDict, error) {
+	if ir.dict != nil {
+		return ir.dict, nil
+	}
+	sec, ok := ir.sections["DICT"]
+	if !ok {
+		return nil, errNoDict
+	}
+	td := &termDict{ br: NewBitReader(ir.fidx) }
+	td.br.Base = sec.offset
+	v, err := td.br.ReadAt(0, 8)
+	if err != nil {
+		return nil, err
+	}
+	td.startBits = int64(v)
+	v, err = td.br.ReadAt(8, 8)
+	if err != nil {
+		return nil, err
+	}
+	td.lenBits = int64(v)
+	v, err = td.br.ReadAt(16, 48)
+	if err != nil {
+		return nil, err
+	}
+	td.count = int64(v)
+	td.br.Base += 8
+	ir.dict = td
+	return td, nil
+}
+func (td *termDict) Len() int64 {
+	return td.count
+}
+
+// Entry returns the first index entry of term k and its length.
+func (td *termDict) Entry(k int64) (start int64, length int, err error) {
+	bits := td.startBits + td.lenBits
+	v, err := td.br.ReadAt(k * bits, td.startBits)
+	if err != nil {
+		return
+	}
+	start = int64(v)
+	v, err = td.br.ReadAt(k * bits + td.startBits, td.lenBits)
+	return start, int(v), err
+}
+
+// Term returns the text of term k and its run of index entries.
+func (ir *IndexReader) Term(k int64) (term []byte, start, end int64, err error) {
+	td, err := ir.Dict()
+	if err != nil {
+		return
+	}
+	start, length, err := td.Entry(k)
+	if err != nil {
+		return
+	}
+	end = ir.count
+	if k + 1 < td.count {
+		end, _, err = td.Entry(k + 1)
+		if err != nil {
+			return
+		}
+	}
+	offset, err := ir.Pos(start)
+	if err != nil {
+		return
+	}
+	str, err := ir.f.ReadAt(offset, ir.buf[0:min(length, len(ir.buf))])
+	if err != nil {
+		return
+	}
+	term = append([]byte(nil), str...)
+	return
+}
+
+// searchFuzzy prints the entries of every term within maxEdits byte edits
+// of q. The sorted dictionary is walked as a trie: an edit distance row is
+// kept per prefix byte and once no extension of a prefix can match, all
+// terms sharing it are skipped with a binary search.
+func searchFuzzy(ctx context.Context, base, index string, q []byte, maxEdits int) {
+	ir, err := OpenIndex(ctx, base, index)
+	if handleErr(err) { return }
+	defer ir.Close()
+	defer ir.PrintSummary()
+	defer ir.PrintSorted()
+	td, err := ir.Dict()
+	if handleErr(err) { return }
+	skip := ir.meta["order"] != "numeric"
+
+	rows := [][]int{ make([]int, len(q) + 1) }
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	var prev []byte
+	for k := int64(0); k < td.Len(); {
+		term, start, end, err := ir.Term(k)
+		if handleErr(err) { return }
+		d := commonPrefix(prev, term)
+		pruned := false
+		for ; d < len(term); d++ {
+			if len(rows) <= d + 1 {
+				rows = append(rows, make([]int, len(q) + 1))
+			}
+			if editRow(rows[d], rows[d+1], q, term[d]) > maxEdits && skip {
+				prefix := term[0:d+1]
+				next, err := bsearch(td.Len() - k, func(i int64) (bool, error) {
+					t, _, _, err := ir.Term(k + i)
+					return !bytes.HasPrefix(t, prefix), err
+				})
+				if handleErr(err) { return }
+				k += next
+				prev, pruned = prefix, true
+				break
+			}
+		}
+		if pruned {
+			continue
+		}
+		if rows[len(term)][len(q)] <= maxEdits {
+			for i := start; i < end; i++ {
+				if handleErr(ir.PrintEntry(i, len(term))) { return }
+			}
+		}
+		prev = term
+		k++
+	}
+}
+
+// editRow fills next, the edit distances of q's prefixes to the current
+// term prefix extended by c, and returns its minimum.
+func editRow(row, next []int, q []byte, c byte) int {
+	next[0] = row[0] + 1
+	low := next[0]
+	for j := 1; j <= len(q); j++ {
+		cost := 1
+		if q[j-1] == c {
+			cost = 0
+		}
+		next[j] = min(min(row[j] + 1, next[j-1] + 1), row[j-1] + cost)
+		if next[j] < low {
+			low = next[j]
+		}
+	}
+	return low
+}
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// listTerms prints every distinct term beginning with prefix with its
+// number of entries and of files holding it.
+func listTerms(ctx context.Context, base, index string, prefix []byte) {
+	ir, err := OpenIndex(ctx, base, index)
+	if handleErr(err) { return }
+	defer ir.Close()
+
+	var s, e int64 = 0, ir.Len()
+	if len(prefix) > 0 {
+		s, e, err = ir.Range(prefix)
+		if handleErr(err) { return }
+	}
+
+	files := make(map[int]bool)
+	handleErr(ir.eachTerm(s, e, func(term []byte, start, end int64) error {
+		for k := range files {
+			delete(files, k)
+		}
+		for i := start; i < end; i++ {
+			offset, err := ir.Pos(i)
+			if err != nil {
+				return err
+			}
+			files[ir.f.OffsetIndex(offset)] = true
+		}
+		fmt.Fprintf(os.Stdout, "%s\t%d\t%d\n", term, end - start, len(files))
+		return nil
+	}))
+}
+
+// eachTerm calls fn with every distinct term of the entries [s, e) and its
+// run of entries. Without a dictionary the term of an entry is taken to be
+// the word, or the run up to a space, it starts.
+func (ir *IndexReader) eachTerm(s, e int64, fn func(term []byte, start, end int64) error) error {
+	if td, err := ir.Dict(); err == nil {
+		k, err := bsearch(td.Len(), func(k int64) (bool, error) {
+			start, _, err := td.Entry(k)
+			return start > s, err
+		})
+		if err != nil {
+			return err
+		}
+		if k > 0 { k-- }
+		for ; k < td.Len(); k++ {
+			term, start, end, err := ir.Term(k)
+			if err != nil {
+				return err
+			}
+			if start >= e { break }
+			if err = fn(term, start, end); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if err != errNoDict {
+		return err
+	}
+
+	var last []byte
+	var lastStart int64
+	for i := s; i < e; i++ {
+		offset, err := ir.Pos(i)
+		if err != nil {
+			return err
+		}
+		str, err := ir.f.ReadAt(offset, ir.buf)
+		if err != nil {
+			return err
+		}
+		term := str[0:entrySpan(str[0:lineEnd(str, 0)])]
+		if i > s && bytes.Equal(term, last) {
+			continue
+		}
+		// fn may read into ir.buf
+		term = append([]byte(nil), term...)
+		if i > s {
+			if err = fn(last, lastStart, i); err != nil {
+				return err
+			}
+		}
+		last, lastStart = term, i
+	}
+	if e > s {
+		return fn(last, lastStart, e)
+	}
+	return nil
+}
+
+// entrySpan guesses the length of the term at the start of b: its leading
+// word, or the run up to the first space.
+func entrySpan(b []byte) int {
+	n := 0
+	for n < len(b) {
+		ok, size := wordRune(b, n)
+		if !ok {
+			break
+		}
+		n += size
+	}
+	if n > 0 {
+		return n
+	}
+	for n < len(b) && b[n] != ' ' && b[n] != '\t' {
+		n++
+	}
+	return n
+}
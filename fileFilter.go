@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+)
+
+// fileRange is the offsets [start, end) of a run of adjacent files.
+type fileRange struct {
+	start, end int64
+}
+
+// FilterFiles limits the hits printed to files whose name matches glob and
+// expr, either may be empty. Files being concatenated, the matching ones
+// turn into a few offset ranges and a hit is tested without reading it.
+func (ir *IndexReader) FilterFiles(glob, expr string) error {
+	if glob == "" && expr == "" {
+		return nil
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	if expr != "" {
+		var err error
+		re, err = regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+	}
+	ir.files = []fileRange{}
+	for i := 0; i < ir.f.FileCount(); i++ {
+		start := ir.f.FileOffset(i)
+		name, _ := ir.f.Filename(start)
+		if glob != "" {
+			ok, _ := path.Match(glob, name)
+			if !ok {
+				ok, _ = path.Match(glob, path.Base(name))
+			}
+			if !ok {
+				continue
+			}
+		}
+		if re != nil && !re.MatchString(name) {
+			continue
+		}
+		end := start + ir.f.FileSize(i)
+		if n := len(ir.files); n > 0 && ir.files[n-1].end == start {
+			ir.files[n-1].end = end
+		} else {
+			ir.files = append(ir.files, fileRange{ start, end })
+		}
+	}
+	return nil
+}
+
+// InFiles reports whether offset lies in a file passing the filter.
+func (ir *IndexReader) InFiles(offset int64) bool {
+	if ir.files == nil {
+		return true
+	}
+	i := sort.Search(len(ir.files), func(i int) bool {
+		return ir.files[i].end > offset
+	})
+	return i < len(ir.files) && ir.files[i].start <= offset
+}
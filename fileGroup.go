@@ -2,22 +2,51 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"os"
 	"path"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 )
 
+type fileHandle struct {
+	*os.File
+	refs int
+	idle *list.Element
+}
+
+// FileGroup reads the files of a directory as one stream. ReadAt, OpenFile
+// and ReleaseFile are safe for concurrent use; Read and Seek keep one cursor
+// for a single reader.
 type FileGroup struct {
 	base    string
 	names   []string
 	sizes   []int64
 	offsets []int64
-	handles []*os.File
+	handles []*fileHandle
 	mapper  [][]byte
 
+	// handleLimit bounds the files kept open, closing the least recently
+	// released once no reader holds them; 0 keeps every file open until
+	// Close. handleLock guards the handles, which workers share.
+	handleLimit int
+	handleLock  sync.Mutex
+	handleOpen  int
+	handleIdle  *list.List
+
+	// mapLimit bounds the files mapped at once, unmapping the least
+	// recently read; 0 maps every file read until Close. mapLock guards
+	// the mappings.
+	mapLimit int
+	mapLock  sync.Mutex
+	mapLRU   *list.List
+	mapElem  map[int]*list.Element
+
 	current       int
 	currentHandle *os.File
 	currentRemain int64
@@ -123,10 +152,11 @@ func (fg *FileGroup) DumpHead() []byte {
 }
 func (fg *FileGroup) Reset() {
 	if fg.handles == nil {
-		fg.handles = make([]*os.File, len(fg.sizes))
+		fg.handles = make([]*fileHandle, len(fg.sizes))
+		fg.handleIdle = list.New()
 	}
+	fg.dropCurrent()
 	fg.current = 0
-	fg.currentHandle = nil
 	if fg.current < len(fg.sizes) {
 		fg.currentRemain = fg.sizes[0]
 	}
@@ -140,24 +170,20 @@ func (fg *FileGroup) Read(p []byte) (n int, err error) {
 		if err != nil {
 			return 0, err
 		}
-		_, err = fg.currentHandle.Seek(fg.sizes[fg.current] - fg.currentRemain, 0)
-		if err != nil {
-			return 0, err
-		}
 	}
 
 	if int64(len(p)) > fg.currentRemain {
 		p = p[0:fg.currentRemain]
 	}
-	n, err = fg.currentHandle.Read(p)
+	n, err = fg.currentHandle.ReadAt(p, fg.sizes[fg.current] - fg.currentRemain)
 	fg.currentRemain -= int64(n)
 	if err == io.EOF {
 		fg.currentRemain = 0
 	}
 
 	if fg.currentRemain <= 0 {
+		fg.dropCurrent()
 		fg.current++
-		fg.currentHandle = nil
 		if fg.current < len(fg.sizes) {
 			fg.currentRemain = fg.sizes[fg.current]
 		}
@@ -166,52 +192,82 @@ func (fg *FileGroup) Read(p []byte) (n int, err error) {
 
 	return
 }
+// ReadAt copies the bytes at offset, up to the end of their file, into buf.
+// Offsets outside the files, as a damaged index may hold, are ErrOutOfRange.
 func (fg *FileGroup) ReadAt(offset int64, buf []byte) ([]byte, error)  {
+	if offset < 0 || offset >= fg.totalSize {
+		return nil, ErrOutOfRange
+	}
 	i := fg.OffsetIndex(offset)
 	offset = offset - fg.offsets[i]
-	h, err := fg.OpenFile(i)
+	fg.mapLock.Lock()
+	defer fg.mapLock.Unlock()
+	b, err := fg.mapFile(i)
 	if err != nil {
 		return nil, err
 	}
-	_, err = h.Seek(offset, 0)
-	if err != nil { return nil, err }
-	buf = buf[0:min(len(buf), int(fg.sizes[i] - offset))]
-	_, err = io.ReadFull(h, buf)
-	if err != nil { return nil, err }
-
-	if i == fg.current {
-		fg.currentHandle = nil
-	}
-	return buf, nil
+	n := copy(buf, b[offset:])
+	return buf[0:n], nil
 }
-var errReadMapperOverFile = errors.New("read mapper over single file")
-func (fg *FileGroup) ReadMapper(offset int64, length int) ([]byte, error) {
-	i := fg.OffsetIndex(offset)
-	offset = offset - fg.offsets[i]
-	size := fg.sizes[i]
-	if offset + int64(length) > size {
-printf("Read File: #%d  %s\n", i, fg.names[i])
-printf("offset %d length %d availSize %d\n", offset, length, size)
-panic(errReadMapperOverFile)
-		return nil, errReadMapperOverFile
+// SetMapLimit keeps at most n files mapped, 0 for no limit.
+func (fg *FileGroup) SetMapLimit(n int) {
+	fg.mapLock.Lock()
+	defer fg.mapLock.Unlock()
+	fg.mapLimit = n
+	fg.unmapOver(n)
+}
+// mapLimit is --max-mapped, by default 256 files for a search. A build sorts
+// by reading entries all over the source, so it keeps every file mapped,
+// only staying under half the kernel's limit on mappings, past which mmap
+// fails.
+func mapLimit(build bool) int {
+	switch {
+	case maxMapped >= 0:
+		return maxMapped
+	case !build:
+		return 256
 	}
-
+	if b, err := os.ReadFile("/proc/sys/vm/max_map_count"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && n > 1 {
+			return n / 2
+		}
+	}
+	return 32768
+}
+func (fg *FileGroup) mapFile(i int) ([]byte, error) {
 	if fg.mapper == nil {
 		fg.mapper = make([][]byte, len(fg.sizes))
+		fg.mapLRU = list.New()
+		fg.mapElem = make(map[int]*list.Element)
 	}
-	b := fg.mapper[i]
-	if b == nil {
-		h, err := fg.OpenFile(i)
-		if err != nil {
-			return nil, err
-		}
-		b, err = syscall.Mmap(int(h.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
-		if err != nil {
-			return nil, err
-		}
-		fg.mapper[i] = b
+	if b := fg.mapper[i]; b != nil {
+		fg.mapLRU.MoveToFront(fg.mapElem[i])
+		return b, nil
+	}
+	h, err := fg.OpenFile(i)
+	if err != nil {
+		return nil, err
+	}
+	b, err := syscall.Mmap(int(h.Fd()), 0, int(fg.sizes[i]), syscall.PROT_READ, syscall.MAP_SHARED)
+	fg.ReleaseFile(i)
+	if err != nil {
+		return nil, err
+	}
+	if fg.mapLimit > 0 {
+		fg.unmapOver(fg.mapLimit - 1)
+	}
+	fg.mapper[i] = b
+	fg.mapElem[i] = fg.mapLRU.PushFront(i)
+	return b, nil
+}
+// unmapOver unmaps the least recently read files past the first n.
+func (fg *FileGroup) unmapOver(n int) {
+	for fg.mapLRU != nil && fg.mapLRU.Len() > n {
+		i := fg.mapLRU.Remove(fg.mapLRU.Back()).(int)
+		syscall.Munmap(fg.mapper[i])
+		fg.mapper[i] = nil
+		delete(fg.mapElem, i)
 	}
-	return b[offset : offset + int64(length)], nil
 }
 var ErrNotSupported = errors.New("not supported")
 var ErrOutOfRange   = errors.New("out of range")
@@ -222,27 +278,29 @@ func (fg *FileGroup) Seek(offset int64, whence int) (int64, error) {
 			return 0, ErrOutOfRange
 		}
 		i := fg.OffsetIndex(offset)
+		fg.dropCurrent()
 		fg.current = i
-		fg.currentHandle = nil
 		fg.currentRemain = fg.offsets[i] + fg.sizes[i] - offset
 		return offset, nil
 	}
 	return 0, ErrNotSupported
 }
 func (fg *FileGroup) Close() (err error) {
-	for i, f := range fg.handles {
-		if f != nil {
-			e := f.Close()
+	fg.dropCurrent()
+	fg.handleLock.Lock()
+	for i, h := range fg.handles {
+		if h != nil {
+			e := h.Close()
 			if e != nil { err = e }
 			fg.handles[i] = nil
 		}
 	}
-	for i, m := range fg.mapper {
-		if m != nil {
-			syscall.Munmap(m)
-			fg.mapper[i] = nil
-		}
-	}
+	fg.handleOpen = 0
+	fg.handleIdle.Init()
+	fg.handleLock.Unlock()
+	fg.mapLock.Lock()
+	defer fg.mapLock.Unlock()
+	fg.unmapOver(0)
 	return
 }
 func (fg *FileGroup) Filename(offset int64) (string, error) {
@@ -273,16 +331,72 @@ func (fg *FileGroup) FileCount() int {
 func (fg *FileGroup) FileOffset(i int) int64 {
 	return fg.offsets[i]
 }
-func (fg *FileGroup) OpenFile(i int) (h *os.File, err error) {
-	h = fg.handles[i]
+// OpenFile opens file i or shares its open handle; every OpenFile needs a
+// ReleaseFile once done with the handle.
+func (fg *FileGroup) OpenFile(i int) (*os.File, error) {
+	fg.handleLock.Lock()
+	defer fg.handleLock.Unlock()
+	h := fg.handles[i]
 	if h == nil {
-		h, err = os.Open(path.Join(fg.base, fg.names[i]))
+		f, err := os.Open(path.Join(fg.base, fg.names[i]))
+		// out of descriptors below the limit: give up idle files instead
+		for errors.Is(err, syscall.EMFILE) && fg.handleIdle.Len() > 0 {
+			fg.closeOldest()
+			f, err = os.Open(path.Join(fg.base, fg.names[i]))
+		}
 		if err != nil {
-			return
+			return nil, err
 		}
+		h = &fileHandle{ File: f }
 		fg.handles[i] = h
+		fg.handleOpen++
+		fg.closeIdle()
+	} else if h.idle != nil {
+		fg.handleIdle.Remove(h.idle)
+		h.idle = nil
+	}
+	h.refs++
+	return h.File, nil
+}
+// ReleaseFile lets file i be closed once no one else holds it.
+func (fg *FileGroup) ReleaseFile(i int) {
+	fg.handleLock.Lock()
+	defer fg.handleLock.Unlock()
+	h := fg.handles[i]
+	if h == nil || h.refs == 0 {
+		return
+	}
+	if h.refs--; h.refs == 0 {
+		h.idle = fg.handleIdle.PushFront(i)
+		fg.closeIdle()
+	}
+}
+// SetHandleLimit keeps at most n files open, 0 for no limit. Files held
+// by readers stay open past it until released.
+func (fg *FileGroup) SetHandleLimit(n int) {
+	fg.handleLock.Lock()
+	defer fg.handleLock.Unlock()
+	fg.handleLimit = n
+	fg.closeIdle()
+}
+// closeIdle closes the least recently released files while over the limit.
+func (fg *FileGroup) closeIdle() {
+	for fg.handleLimit > 0 && fg.handleOpen > fg.handleLimit && fg.handleIdle.Len() > 0 {
+		fg.closeOldest()
+	}
+}
+func (fg *FileGroup) closeOldest() {
+	i := fg.handleIdle.Remove(fg.handleIdle.Back()).(int)
+	fg.handles[i].Close()
+	fg.handles[i] = nil
+	fg.handleOpen--
+}
+// dropCurrent releases the file Read is in.
+func (fg *FileGroup) dropCurrent() {
+	if fg.currentHandle != nil {
+		fg.currentHandle = nil
+		fg.ReleaseFile(fg.current)
 	}
-	return
 }
 func (fg *FileGroup) OffsetIndex(offset int64) int {
 	i, j := 0, len(fg.offsets)
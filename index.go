@@ -248,6 +248,10 @@ type Index struct {
 	datStruct IndexDataStruct
 	datCount  int64
 	pool      *FileGroup
+	tags      []byte
+	compare   func(a, b []byte) int
+	prefixes  []byte
+	prefixLen int
 
 	swapCount        int64
 	compareCount     int64
@@ -263,18 +267,26 @@ func NewIndex(entryCount int, datStruct IndexDataStruct, pool *FileGroup) *Index
 		dat: make([]byte, datSize),
 		datStruct: datStruct,
 		pool: pool,
+		compare: bytes.Compare,
 
 		regA: -1,
 		regB: -1,
 	}
 }
-func (idx *Index) Push(pos int64, length int) {
+// EnableTags keeps a tag byte next to every entry.
+func (idx *Index) EnableTags() {
+	idx.tags = make([]byte, len(idx.dat) / idx.datStruct.chunkLen)
+}
+func (idx *Index) Push(pos int64, length int, tag int) {
 	i := int(atomic.AddInt64(&idx.datCount, 1)) - 1
 	idx.datStruct.Put(idx.dat, i, pos, length)
+	if idx.tags != nil {
+		idx.tags[i] = byte(tag)
+	}
 }
 func (idx *Index) Len() int           { return int(idx.datCount) }
 func (idx *Index) Swap(i, j int)      {
-	idx.swapCount++
+	atomic.AddInt64(&idx.swapCount, 1)
 
 	if idx.regA == i {
 		idx.regA = j
@@ -288,45 +300,69 @@ func (idx *Index) Swap(i, j int)      {
 	}
 
 	idx.datStruct.Swap(idx.dat, i, j)
+	if idx.tags != nil {
+		idx.tags[i], idx.tags[j] = idx.tags[j], idx.tags[i]
+	}
+	if idx.prefixes != nil {
+		n := idx.prefixLen
+		for k := 0; k < n; k++ {
+			idx.prefixes[i*n+k], idx.prefixes[j*n+k] = idx.prefixes[j*n+k], idx.prefixes[i*n+k]
+		}
+	}
 }
 func (idx *Index) Less(i, j int) bool {
-	idx.compareCount++
+	atomic.AddInt64(&idx.compareCount, 1)
+	if idx.prefixes != nil {
+		if c, ok := idx.comparePrefix(i, j); ok {
+			return c < 0
+		}
+	}
 
+	// the registers keep copies, reading another entry may unmap the file
+	// an earlier one came from
 	var a, b []byte
 	switch {
 	case i == idx.regA:
 		a = idx.regAV
-		b = idx.Get(j)
+		b = idx.read(j, idx.regBV)
 		idx.regB = j
 		idx.regBV = b
 	case i == idx.regB:
 		a = idx.regBV
-		b = idx.Get(j)
+		b = idx.read(j, idx.regAV)
 		idx.regA = j
 		idx.regAV = b
 	case j == idx.regB:
 		b = idx.regBV
-		a = idx.Get(i)
+		a = idx.read(i, idx.regAV)
 		idx.regA = i
 		idx.regAV = a
 	case j == idx.regA:
 		b = idx.regAV
-		a = idx.Get(i)
+		a = idx.read(i, idx.regBV)
 		idx.regB = i
 		idx.regBV = a
 	default:
-		a = idx.Get(i)
+		a = idx.read(i, idx.regAV)
 		idx.regA = i
 		idx.regAV = a
-		b = idx.Get(j)
+		b = idx.read(j, idx.regBV)
 		idx.regB = j
 		idx.regBV = b
 	}
-	return bytes.Compare(a, b) == -1
+	return idx.compare(a, b) < 0
 }
+// Get returns a copy of the text of entry i.
 func (idx *Index) Get(i int) []byte {
+	return idx.read(i, nil)
+}
+// read copies the text of entry i into buf, growing it when too small.
+func (idx *Index) read(i int, buf []byte) []byte {
 	pos, length := idx.datStruct.Get(idx.dat, i)
-	dat, err := idx.pool.ReadMapper(pos, length)
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	dat, err := idx.pool.ReadAt(pos, buf[0:length])
 	handleErr(err)
 	return dat
 }
@@ -334,26 +370,31 @@ func (idx *Index) GetPos(i int) int64 {
 	pos, _ := idx.datStruct.Get(idx.dat, i)
 	return pos
 }
+func (idx *Index) GetTag(i int) int {
+	return int(idx.tags[i])
+}
 func (idx *Index) ResetStat() {
-	idx.swapCount = 0
-	idx.compareCount = 0
+	atomic.StoreInt64(&idx.swapCount, 0)
+	atomic.StoreInt64(&idx.compareCount, 0)
 	idx.lastSwapCount = 0
 	idx.lastCompareCount = 0
 }
 func (idx *Index) PrintStat(d time.Duration, last bool) {
+	compareCount := atomic.LoadInt64(&idx.compareCount)
+	swapCount := atomic.LoadInt64(&idx.swapCount)
 	var compSpeed, swapSpeed float64
 	var compSpeedUnit, swapSpeedUnit string
 	if last {
-		compSpeed, compSpeedUnit = FormatUnit(float64(idx.compareCount) / d.Seconds())
-		swapSpeed, swapSpeedUnit = FormatUnit(float64(idx.swapCount) / d.Seconds())
+		compSpeed, compSpeedUnit = FormatUnit(float64(compareCount) / d.Seconds())
+		swapSpeed, swapSpeedUnit = FormatUnit(float64(swapCount) / d.Seconds())
 	} else {
-		compSpeed, compSpeedUnit = FormatUnit(float64(idx.compareCount - idx.lastCompareCount) / d.Seconds())
-		swapSpeed, swapSpeedUnit = FormatUnit(float64(idx.swapCount - idx.lastSwapCount) / d.Seconds())
+		compSpeed, compSpeedUnit = FormatUnit(float64(compareCount - idx.lastCompareCount) / d.Seconds())
+		swapSpeed, swapSpeedUnit = FormatUnit(float64(swapCount - idx.lastSwapCount) / d.Seconds())
 	}
 	printf(" Comp: %12d(%10.3f) %6.1f%s/s  Swap: %12d(%10.3fs) %6.1f%s/s",
-		idx.compareCount, float64(idx.compareCount) / float64(idx.datCount), compSpeed, compSpeedUnit,
-		idx.swapCount, float64(idx.swapCount) / float64(idx.datCount), swapSpeed, swapSpeedUnit)
-	idx.lastCompareCount = idx.compareCount
-	idx.lastSwapCount = idx.swapCount
+		compareCount, float64(compareCount) / float64(idx.datCount), compSpeed, compSpeedUnit,
+		swapCount, float64(swapCount) / float64(idx.datCount), swapSpeed, swapSpeedUnit)
+	idx.lastCompareCount = compareCount
+	idx.lastSwapCount = swapCount
 }
 
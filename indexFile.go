@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexMeta records how an index was built. It is written right after the
+// FileGroup head as a 0 byte, a 32-bit length and "key=value" lines; indexes
+// without it start the position stream directly with posBits, never 0.
+type indexMeta map[string]string
+
+func (meta indexMeta) Int(key string) int {
+	i, _ := strconv.Atoi(meta[key])
+	return i
+}
+func (meta indexMeta) Dump() []byte {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(bytes.Buffer)
+	for _, k := range keys {
+		buf.WriteString(k + "=" + meta[k] + "\n")
+	}
+	head := make([]byte, 5)
+	binary.BigEndian.PutUint32(head[1:], uint32(buf.Len()))
+	return append(head, buf.Bytes()...)
+}
+
+var errBadIndexMeta = errors.New("bad index meta")
+
+func readIndexMeta(r io.ReadSeeker) (indexMeta, error) {
+	meta := indexMeta{}
+	head := make([]byte, 5)
+	_, err := io.ReadFull(r, head[0:1])
+	if err != nil {
+		return nil, err
+	}
+	if head[0] != 0 {
+		_, err = r.Seek(-1, 1)
+		return meta, err
+	}
+	_, err = io.ReadFull(r, head[1:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(head[1:]))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, errBadIndexMeta
+		}
+		meta[line[0:i]] = line[i+1:]
+	}
+	return meta, nil
+}
+
+func writeIndexHead(w io.Writer, f *FileGroup, meta indexMeta) (err error) {
+	if _, err = w.Write([]byte("INDEX")); err != nil {
+		return
+	}
+	if _, err = w.Write(f.DumpHead()); err != nil {
+		return
+	}
+	_, err = w.Write(meta.Dump())
+	return
+}
+
+var errNotIndexFile = errors.New("not index file")
+var errTruncatedIndex = errors.New("index file is truncated")
+
+type IndexReader struct {
+	ctx     context.Context
+	f       *FileGroup
+	fidx    *os.File
+	br      *BitReader
+	meta    indexMeta
+	posBits int64
+	tagBits int64
+	count   int64
+	blocks  *blockPositions
+	bits    int64
+
+	sections  map[string]indexSection
+	dict      *termDict
+	rev       *reversedIndex
+	skip      []skipSample
+	skipEvery int64
+	inline    int
+	files     []fileRange
+	summary   *hitSummary
+	sorter    *hitSorter
+
+	buf     []byte
+	headers map[int][]string
+}
+// OpenIndex opens an index for one search, which gives up with the error
+// of ctx once it is done.
+func OpenIndex(ctx context.Context, base, index string) (ir *IndexReader, err error) {
+	ir = &IndexReader{
+		ctx: ctx,
+		buf: make([]byte, 4 * 1024),
+	}
+	ir.fidx, err = os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ir.Close()
+			ir = nil
+		}
+	}()
+
+	buf5 := make([]byte, 5)
+	_, err = io.ReadFull(ir.fidx, buf5)
+	if err != nil { return }
+	if string(buf5) != "INDEX" {
+		err = errNotIndexFile
+		return
+	}
+	ir.f, err = NewFileGroupReadHead(base, ir.fidx)
+	if err != nil { return }
+	ir.f.SetMapLimit(mapLimit(false))
+	ir.f.SetHandleLimit(maxOpen)
+	ir.meta, err = readIndexMeta(ir.fidx)
+	if err != nil { return }
+
+	ir.br = NewBitReader(ir.fidx)
+	ir.br.Base, err = ir.fidx.Seek(0, 1)
+	if err != nil { return }
+
+	var v uint64
+	v, err = ir.br.ReadAt(0, 8)
+	if err != nil { return }
+	ir.posBits = int64(v)
+	v, err = ir.br.ReadAt(8, 56)
+	if err != nil { return }
+	ir.count = int64(v)
+	ir.br.Base += 8
+	ir.tagBits = int64(ir.meta.Int("tagbits"))
+	ir.bits = ir.count * (ir.posBits + ir.tagBits)
+	if ir.meta["positions"] == "blocks" {
+		ir.blocks = newBlockPositions(ir)
+		if ir.bits, err = ir.blocks.end(); err != nil { return }
+	}
+	fi, err := ir.fidx.Stat()
+	if err != nil { return }
+	if fi.Size() < ir.streamEnd() {
+		err = errTruncatedIndex
+		return
+	}
+	if err = ir.readSections(); err != nil { return }
+	if summaryMode != "" {
+		ir.summary = new(hitSummary)
+	} else if sortOrder == "position" {
+		ir.sorter = new(hitSorter)
+	}
+	err = ir.FilterFiles(fileGlob, fileRegex)
+	return
+}
+func (ir *IndexReader) Close() error {
+	if ir.sorter != nil {
+		ir.sorter.Close()
+	}
+	if ir.f != nil {
+		ir.f.Close()
+	}
+	return ir.fidx.Close()
+}
+func (ir *IndexReader) Len() int64 {
+	return ir.count
+}
+func (ir *IndexReader) Pos(i int64) (int64, error) {
+	if err := ir.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ir.blocks != nil {
+		return ir.blocks.Pos(i)
+	}
+	v, err := ir.br.ReadAt(i * (ir.posBits + ir.tagBits), ir.posBits)
+	return int64(v), err
+}
+func (ir *IndexReader) Tag(i int64) (int, error) {
+	if ir.tagBits == 0 {
+		return 0, nil
+	}
+	if ir.blocks != nil {
+		return ir.blocks.Tag(i)
+	}
+	v, err := ir.br.ReadAt(i * (ir.posBits + ir.tagBits) + ir.posBits, ir.tagBits)
+	return int(v), err
+}
+
+// TagName names the column a tag stands for, looking numbered columns up in
+// the header record of the file holding offset.
+func (ir *IndexReader) TagName(tag int, offset int64) string {
+	columns := strings.Split(ir.meta["columns"], ",")
+	if tag >= len(columns) {
+		return ""
+	}
+	format := ir.meta["format"]
+	col, err := strconv.Atoi(columns[tag])
+	if err != nil || format != "csv" && format != "tsv" {
+		return columns[tag]
+	}
+	file := ir.f.OffsetIndex(offset)
+	if ir.headers == nil {
+		ir.headers = make(map[int][]string)
+	}
+	header, ok := ir.headers[file]
+	if !ok {
+		comma := byte(',')
+		if format == "tsv" {
+			comma = '\t'
+		}
+		h, err := ir.f.OpenFile(file)
+		if err == nil {
+			var record []byte
+			var fields []fieldSpan
+			r := io.NewSectionReader(h, 0, ir.f.FileSize(file))
+			record, fields, _ = readRecord(bufio.NewReader(r), comma, nil, nil)
+			for _, fld := range fields {
+				header = append(header, string(record[fld.start : fld.end]))
+			}
+			ir.f.ReleaseFile(file)
+		}
+		ir.headers[file] = header
+	}
+	if col < 1 || col > len(header) {
+		return columns[tag]
+	}
+	return header[col - 1]
+}
+
+// compareAt compares the text of entry i with q, 0 meaning it begins with q.
+// It orders indexes without a dictionary: suffix arrays, whose entries run
+// to the line end.
+func (ir *IndexReader) compareAt(i int64, q []byte) (int, error) {
+	if c, ok, err := ir.inlineAt(i, q); err != nil || ok {
+		return c, err
+	}
+	offset, err := ir.Pos(i)
+	if err != nil {
+		return 0, err
+	}
+	if ir.meta["order"] == "numeric" {
+		// read past q for the end of a digit run q ends in
+		str, err := ir.f.ReadAt(offset, ir.buf[0:min(len(ir.buf), len(q) + 64)])
+		if err != nil {
+			return 0, err
+		}
+		return comparePrefixNumeric(str[0:lineEnd(str, 0)], q), nil
+	}
+	str, err := ir.f.ReadAt(offset, ir.buf[0:len(q)])
+	if err != nil {
+		return 0, err
+	}
+	return bytes.Compare(str[0:lineEnd(str, 0)], q), nil
+}
+
+// compareTerm compares term k with q, 0 meaning it begins with q. Only the
+// term is read, as the index is sorted by it and not by the text after.
+func (ir *IndexReader) compareTerm(k int64, q []byte) (int, error) {
+	start, length, err := ir.dict.Entry(k)
+	if err != nil {
+		return 0, err
+	}
+	if c, ok, err := ir.inlineAt(start, q); err != nil || ok {
+		return c, err
+	}
+	offset, err := ir.Pos(start)
+	if err != nil {
+		return 0, err
+	}
+	if ir.meta["order"] == "numeric" {
+		str, err := ir.f.ReadAt(offset, ir.buf[0:min(len(ir.buf), length)])
+		if err != nil {
+			return 0, err
+		}
+		return comparePrefixNumeric(str, q), nil
+	}
+	str, err := ir.f.ReadAt(offset, ir.buf[0:min(length, len(q))])
+	if err != nil {
+		return 0, err
+	}
+	return bytes.Compare(str, q), nil
+}
+
+// termStart returns the first entry of term k, the entry count past the
+// last term.
+func (ir *IndexReader) termStart(k int64) (int64, error) {
+	if k >= ir.dict.Len() {
+		return ir.count, nil
+	}
+	start, _, err := ir.dict.Entry(k)
+	return start, err
+}
+
+// search returns the first of [start, end), entries or with terms set
+// dictionary terms, whose comparison with q satisfies pred.
+func (ir *IndexReader) search(start, end int64, q []byte, pred func(c int) bool, terms bool) (int64, error) {
+	lo, hi, err := ir.narrow(start, end, q, pred, terms)
+	if err != nil {
+		return 0, err
+	}
+	compare := ir.compareAt
+	if terms {
+		compare = ir.compareTerm
+	}
+	i, err := bsearch(hi - lo, func(i int64) (bool, error) {
+		c, err := compare(lo + i, q)
+		return pred(c), err
+	})
+	return lo + i, err
+}
+
+// Range returns the entries [start, end) whose term begins with q.
+func (ir *IndexReader) Range(q []byte) (start, end int64, err error) {
+	return ir.Between(q, q, false)
+}
+
+// Between returns the entries [start, end) from the first whose term begins
+// with from up to the last whose term begins with to, or the last before it
+// when exclusive is set. Nil bounds are open. With a dictionary its terms
+// are searched, else the entries themselves.
+func (ir *IndexReader) Between(from, to []byte, exclusive bool) (start, end int64, err error) {
+	if len(from) > len(ir.buf) / 2 {
+		from = from[0:len(ir.buf) / 2]
+	}
+	if len(to) > len(ir.buf) / 2 {
+		to = to[0:len(ir.buf) / 2]
+	}
+	n, terms := ir.count, false
+	if td, err := ir.Dict(); err == nil {
+		n, terms = td.Len(), true
+	} else if err != errNoDict {
+		return 0, 0, err
+	}
+	end = n
+	if from != nil {
+		start, err = ir.search(0, n, from, func(c int) bool { return c >= 0 }, terms)
+		if err != nil { return }
+	}
+	if to != nil {
+		end, err = ir.search(start, n, to, func(c int) bool { return c > 0 || exclusive && c == 0 }, terms)
+		if err != nil { return }
+	}
+	if terms {
+		if start, err = ir.termStart(start); err != nil { return }
+		end, err = ir.termStart(end)
+	}
+	return
+}
+
+// eachMatch calls fn with every entry whose text begins with q, in index
+// order. Besides the terms beginning with q these can be terms that are
+// themselves a prefix of q, followed in the source by the rest of it, like
+// the short n-grams ending a CJK run. Every candidate is checked against
+// the source.
+func (ir *IndexReader) eachMatch(q []byte, fn func(i int64, length int) error) error {
+	if len(q) > len(ir.buf) / 2 {
+		q = q[0:len(ir.buf) / 2]
+	}
+	each := func(start, end int64, length int) error {
+		for i := start; i < end; i++ {
+			ok, err := ir.matchAt(i, q)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err = fn(i, length); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	td, err := ir.Dict()
+	if err != nil && err != errNoDict {
+		return err
+	}
+	if err == nil && ir.meta["order"] != "numeric" {
+		var k int64
+		for j := 1; j < len(q); j++ {
+			k, err = ir.search(k, td.Len(), q[0:j], func(c int) bool { return c >= 0 }, true)
+			if err != nil {
+				return err
+			}
+			if k == td.Len() {
+				return nil
+			}
+			c, err := ir.compareTerm(k, q[0:j])
+			if err != nil {
+				return err
+			}
+			if c != 0 {
+				// no term begins with q[0:j], let alone with q
+				return nil
+			}
+			start, length, err := td.Entry(k)
+			if err != nil {
+				return err
+			}
+			if length != j {
+				continue
+			}
+			end, err := ir.termStart(k + 1)
+			if err != nil {
+				return err
+			}
+			if err = each(start, end, len(q)); err != nil {
+				return err
+			}
+		}
+	}
+	start, end, err := ir.Range(q)
+	if err != nil {
+		return err
+	}
+	if td != nil && ir.meta["order"] == "numeric" {
+		// numerically equal terms differ in length, "id7" matching "id007"
+		return ir.eachTerm(start, end, func(term []byte, s, e int64) error {
+			if s < start {
+				s = start
+			}
+			return each(s, min64(e, end), len(term))
+		})
+	}
+	return each(start, end, len(q))
+}
+
+// matchAt reports whether the text of entry i begins with q.
+func (ir *IndexReader) matchAt(i int64, q []byte) (bool, error) {
+	offset, err := ir.Pos(i)
+	if err != nil {
+		return false, err
+	}
+	if ir.meta["order"] == "numeric" {
+		str, err := ir.f.ReadAt(offset, ir.buf[0:min(len(ir.buf), len(q) + 64)])
+		if err != nil {
+			return false, err
+		}
+		return comparePrefixNumeric(str[0:lineEnd(str, 0)], q) == 0, nil
+	}
+	str, err := ir.f.ReadAt(offset, ir.buf[0:len(q)])
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(str[0:lineEnd(str, 0)], q), nil
+}
+
+// PrintEntry prints the line of entry i with length bytes highlighted.
+func (ir *IndexReader) PrintEntry(i int64, length int) error {
+	offset, err := ir.Pos(i)
+	if err != nil {
+		return err
+	}
+	tag, err := ir.Tag(i)
+	if err != nil {
+		return err
+	}
+	return ir.printTagged(offset, length, tag)
+}
+
+// printTagged is PrintEntry for an entry already read.
+func (ir *IndexReader) printTagged(offset int64, length, tag int) error {
+	if !ir.InFiles(offset) {
+		return nil
+	}
+	if ir.summary != nil {
+		return ir.summarize(offset)
+	}
+	if ir.sorter != nil {
+		return ir.sorter.Add(posHit{ offset, length, tag })
+	}
+	var label string
+	if ir.tagBits > 0 {
+		label = ir.TagName(tag, offset)
+	}
+	if err := ir.PrintHit(offset, length, label); err != nil {
+		return err
+	}
+	if prettyJSON && ir.meta["format"] == "json" {
+		return ir.PrintJSON(offset)
+	}
+	return nil
+}
+
+// PrintHit prints the line holding offset with length bytes highlighted,
+// after the file name and label if any, unless its file is filtered out.
+func (ir *IndexReader) PrintHit(offset int64, length int, label string) error {
+	if err := ir.ctx.Err(); err != nil {
+		return err
+	}
+	if !ir.InFiles(offset) {
+		return nil
+	}
+	if ir.summary != nil {
+		return ir.summarize(offset)
+	}
+	if ir.sorter != nil {
+		return ir.sorter.Add(posHit{ offset, length, -1 })
+	}
+	base := (offset / 1024 - 1) * 1024
+	fileStart := ir.f.FileOffset(ir.f.OffsetIndex(offset))
+	if base < fileStart { base = fileStart }
+
+	str, err := ir.f.ReadAt(base, ir.buf)
+	if err != nil {
+		return err
+	}
+	offsetBuf := int(offset - base)
+	endBuf := min(offsetBuf + length, len(str))
+	filename, _ := ir.f.Filename(offset)
+	lineLeft := str[lineStart(str, offsetBuf) : offsetBuf]
+	lineRight := str[endBuf : lineEnd(str, endBuf)]
+
+	if label != "" {
+		filename += " [" + label + "]"
+	}
+	if endBuf == offsetBuf {
+		fmt.Fprintf(os.Stdout, "%s: %s%s\n", filename, lineLeft, lineRight)
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "%s: %s\033[32m%s\033[0m%s\n",
+		filename, lineLeft, str[offsetBuf : endBuf], lineRight)
+	return nil
+}
+
+// LineStart returns the offset of the line holding offset.
+func (ir *IndexReader) LineStart(offset int64) (int64, error) {
+	fileStart := ir.f.FileOffset(ir.f.OffsetIndex(offset))
+	for end := offset; end > fileStart; {
+		base := end - int64(len(ir.buf))
+		if base < fileStart { base = fileStart }
+		str, err := ir.f.ReadAt(base, ir.buf[0:end - base])
+		if err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(str, '\n'); i >= 0 {
+			return base + int64(i) + 1, nil
+		}
+		end = base
+	}
+	return fileStart, nil
+}
+
+// ReadLine returns the line starting at start, without its line break.
+func (ir *IndexReader) ReadLine(start int64) ([]byte, error) {
+	var line []byte
+	fileEnd := ir.f.FileOffset(ir.f.OffsetIndex(start)) + ir.f.FileSize(ir.f.OffsetIndex(start))
+	for offset := start; offset < fileEnd; {
+		str, err := ir.f.ReadAt(offset, ir.buf)
+		if err != nil {
+			return nil, err
+		}
+		if i := bytes.IndexByte(str, '\n'); i >= 0 {
+			line = append(line, str[0:i]...)
+			break
+		}
+		line = append(line, str...)
+		offset += int64(len(str))
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[0:n-1]
+	}
+	return line, nil
+}
+
+// PrintJSON pretty prints the JSON object on the line holding offset.
+func (ir *IndexReader) PrintJSON(offset int64) error {
+	start, err := ir.LineStart(offset)
+	if err != nil {
+		return err
+	}
+	line, err := ir.ReadLine(start)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if json.Indent(buf, line, "    ", "  ") != nil {
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "    %s\n", buf.Bytes())
+	return nil
+}
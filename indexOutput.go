@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var errIndexLocked = errors.New("index is being built by another process")
+
+// indexOutput is an index being built: a temporary file beside the index,
+// renamed over it by Commit, and a lock file keeping a second build of the
+// same index out meanwhile. Searches keep seeing the old index until then.
+type indexOutput struct {
+	*os.File
+	path     string
+	lock     string
+	lockFile *os.File
+}
+
+func createIndex(outfile string) (out *indexOutput, err error) {
+	out = &indexOutput{ path: outfile, lock: outfile + ".lock" }
+	if err = out.takeLock(); err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(outfile)
+	if dir == "" {
+		dir = "."
+	}
+	out.File, err = os.CreateTemp(dir, "." + strings.TrimLeft(name, ".") + ".tmp-")
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if err != nil {
+		out.Abort()
+		return nil, err
+	}
+	return out, nil
+}
+
+// takeLock locks the lock file with flock, which the kernel releases when
+// the process dies, so a lock left by a crash is free again. A lock taken on
+// a file another build has just removed is retried on the new one.
+func (out *indexOutput) takeLock() error {
+	for {
+		f, err := os.OpenFile(out.lock, os.O_WRONLY | os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			err = errIndexLocked
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if !lockCurrent(f, out.lock) {
+			f.Close()
+			continue
+		}
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+		}
+		if err != nil {
+			os.Remove(out.lock)
+			f.Close()
+			return err
+		}
+		out.lockFile = f
+		return nil
+	}
+}
+// lockCurrent tells whether f is still the file at name.
+func lockCurrent(f *os.File, name string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(name)
+	return err == nil && os.SameFile(fi, cur)
+}
+
+// Commit syncs the temporary file and renames it over the index.
+func (out *indexOutput) Commit() error {
+	if out.File == nil {
+		return os.ErrClosed
+	}
+	err := out.Sync()
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), out.path)
+	}
+	if err != nil {
+		out.Abort()
+		return err
+	}
+	out.File = nil
+	if d, err := os.Open(path.Dir(out.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	out.Abort()
+	return nil
+}
+
+// Abort drops the temporary file unless committed, and releases the lock.
+func (out *indexOutput) Abort() {
+	if out.File != nil {
+		out.Close()
+		os.Remove(out.Name())
+		out.File = nil
+	}
+	// removed while still locked, see takeLock
+	if out.lockFile != nil {
+		os.Remove(out.lock)
+		out.lockFile.Close()
+		out.lockFile = nil
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The "PREF" section keeps the first N bytes of every entry's key, in entry
+// order, so binary searches need not read the source: N (32 bits), then per
+// entry a byte with the length and 0x80 when the key ended within N bytes,
+// and N bytes of it. The key is the term, or for a suffix array the text up
+// to the line end.
+const inlineMax = 127
+
+var errInlineNumeric = errors.New("--inline does not work with --numeric")
+var errInlineSize = errors.New("--inline takes 1 to 127 bytes")
+
+// entryPrefix reads up to len(buf) bytes of the text at pos into buf, cut at
+// its line end, and tells whether the line ended.
+func entryPrefix(f *FileGroup, pos int64, buf []byte) ([]byte, bool, error) {
+	b, err := f.ReadAt(pos, buf)
+	if err != nil {
+		return nil, false, err
+	}
+	end := lineEnd(b, 0)
+	return b[0:end], end < len(buf), nil
+}
+
+// termPrefix returns up to n bytes of term i of a sorted index and whether
+// that is all of it.
+func termPrefix(index *Index, i, n int) ([]byte, bool, error) {
+	term := index.Get(i)
+	return term[0:min(len(term), n)], len(term) <= n, nil
+}
+
+// DumpPrefixes encodes the inline prefixes of count entries, given by key.
+func DumpPrefixes(count, n int, key func(i int) ([]byte, bool, error)) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 4 + count * (n + 1)))
+	rec := make([]byte, n + 1)
+	binary.BigEndian.PutUint32(rec, uint32(n))
+	buf.Write(rec[0:4])
+	for i := 0; i < count; i++ {
+		b, whole, err := key(i)
+		if err != nil {
+			return nil, err
+		}
+		for k := range rec {
+			rec[k] = 0
+		}
+		rec[0] = byte(len(b))
+		if whole {
+			rec[0] |= 0x80
+		}
+		copy(rec[1:], b)
+		buf.Write(rec)
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadPrefixes keeps the first n bytes of every term in memory so Less can
+// mostly do without reading the source.
+func (idx *Index) LoadPrefixes(n int) {
+	idx.prefixLen = n
+	idx.prefixes = make([]byte, idx.Len() * n)
+	for i := 0; i < idx.Len(); i++ {
+		pos, length := idx.datStruct.Get(idx.dat, i)
+		_, err := idx.pool.ReadAt(pos, idx.prefixes[i * n : i * n + min(length, n)])
+		handleErr(err)
+	}
+}
+
+// comparePrefix compares entries i and j by their prefixes, ok false when
+// both terms are longer than the prefix and it ties. Equal prefixes put the
+// shorter term first, as the shorter is then a prefix of the other.
+func (idx *Index) comparePrefix(i, j int) (c int, ok bool) {
+	n := idx.prefixLen
+	_, li := idx.datStruct.Get(idx.dat, i)
+	_, lj := idx.datStruct.Get(idx.dat, j)
+	a := idx.prefixes[i * n : i * n + min(li, n)]
+	b := idx.prefixes[j * n : j * n + min(lj, n)]
+	if c = bytes.Compare(a, b); c != 0 {
+		return c, true
+	}
+	switch {
+	case li > n && lj > n:
+		return 0, false
+	case li < lj:
+		return -1, true
+	case li > lj:
+		return 1, true
+	}
+	return 0, true
+}
+
+// inlineAt compares the prefix of entry i with q like compareAt, ok false
+// when the index has no prefixes or they do not decide it.
+func (ir *IndexReader) inlineAt(i int64, q []byte) (c int, ok bool, err error) {
+	sec, has := ir.sections["PREF"]
+	if !has || ir.meta["order"] == "numeric" {
+		return 0, false, nil
+	}
+	if ir.inline == 0 {
+		head := make([]byte, 4)
+		if _, err = ir.fidx.ReadAt(head, sec.offset); err != nil {
+			return
+		}
+		ir.inline = int(binary.BigEndian.Uint32(head))
+		if ir.inline < 1 || ir.inline > inlineMax {
+			return 0, false, errBadInline
+		}
+	}
+	rec := ir.buf[len(ir.buf) - ir.inline - 1:]
+	if _, err = ir.fidx.ReadAt(rec, sec.offset + 4 + i * int64(ir.inline + 1)); err != nil {
+		return
+	}
+	length := int(rec[0] & 0x7F)
+	if length > ir.inline {
+		return 0, false, errBadInline
+	}
+	sp := skipSample{ prefix: rec[1 : 1 + length], whole: rec[0] & 0x80 != 0 }
+	c, ok = sp.compare(q)
+	return
+}
+
+var errBadInline = errors.New("bad inline prefixes")
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// jsonFormat picks values out of JSON Lines by dotted key path. Array
+// elements share the path of the array; the position of the path in the
+// list is the tag stored per entry.
+type jsonFormat struct {
+	paths    map[string]int
+	prefixes map[string]bool
+}
+
+func NewJSONSpliter(paths string) (*WordSpliter, error) {
+	jf := &jsonFormat{
+		paths:    make(map[string]int),
+		prefixes: make(map[string]bool),
+	}
+	var list []string
+	for _, p := range strings.Split(paths, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		jf.paths[p] = len(list)
+		list = append(list, p)
+		for i := 0; i < len(p); i++ {
+			if p[i] == '.' {
+				jf.prefixes[p[0:i]] = true
+			}
+		}
+	}
+	if len(list) == 0 {
+		return nil, errNoColumns
+	}
+	ws := new(WordSpliter)
+	ws.json = jf
+	ws.TagBits = tagBitsFor(len(list))
+	ws.Meta = indexMeta{
+		"format":  "json",
+		"columns": strings.Join(list, ","),
+		"tagbits": strconv.Itoa(int(ws.TagBits)),
+	}
+	return ws, nil
+}
+
+// fields calls emit with the span of every wanted value in line. String
+// values are given without their quotes, other scalars as written.
+func (jf *jsonFormat) fields(line []byte, emit func(start, end, tag int)) {
+	jp := jsonParser{ b: line, jf: jf, emit: emit }
+	jp.value(jp.space(0), "", true)
+}
+
+type jsonParser struct {
+	b    []byte
+	jf   *jsonFormat
+	emit func(start, end, tag int)
+}
+
+func (jp *jsonParser) space(i int) int {
+	for i < len(jp.b) {
+		switch jp.b[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// value parses the value at i and returns the index after it, or -1 when
+// the line is not valid JSON.
+func (jp *jsonParser) value(i int, path string, want bool) int {
+	if i >= len(jp.b) {
+		return -1
+	}
+	tag, wanted := jp.jf.paths[path]
+	wanted = wanted && want
+	switch c := jp.b[i]; {
+	case c == '{':
+		i = jp.space(i + 1)
+		if i < len(jp.b) && jp.b[i] == '}' {
+			return i + 1
+		}
+		for i < len(jp.b) {
+			keyStart := i
+			i = jp.str(i)
+			if i < 0 {
+				return -1
+			}
+			child, childWant := "", false
+			if want {
+				key := jp.key(keyStart, i)
+				child = key
+				if path != "" {
+					child = path + "." + key
+				}
+				_, ok := jp.jf.paths[child]
+				childWant = ok || jp.jf.prefixes[child]
+			}
+			i = jp.space(i)
+			if i >= len(jp.b) || jp.b[i] != ':' {
+				return -1
+			}
+			i = jp.value(jp.space(i + 1), child, childWant)
+			if i < 0 {
+				return -1
+			}
+			i = jp.space(i)
+			if i < len(jp.b) && jp.b[i] == '}' {
+				return i + 1
+			}
+			if i >= len(jp.b) || jp.b[i] != ',' {
+				return -1
+			}
+			i = jp.space(i + 1)
+		}
+		return -1
+	case c == '[':
+		i = jp.space(i + 1)
+		if i < len(jp.b) && jp.b[i] == ']' {
+			return i + 1
+		}
+		for i < len(jp.b) {
+			i = jp.value(i, path, want)
+			if i < 0 {
+				return -1
+			}
+			i = jp.space(i)
+			if i < len(jp.b) && jp.b[i] == ']' {
+				return i + 1
+			}
+			if i >= len(jp.b) || jp.b[i] != ',' {
+				return -1
+			}
+			i = jp.space(i + 1)
+		}
+		return -1
+	case c == '"':
+		end := jp.str(i)
+		if end > 0 && wanted && end - 1 > i + 1 {
+			jp.emit(i + 1, end - 1, tag)
+		}
+		return end
+	default:
+		start := i
+		for i < len(jp.b) && (isAlnum(jp.b[i]) || jp.b[i] == '-' || jp.b[i] == '+' || jp.b[i] == '.') {
+			i++
+		}
+		if i == start {
+			return -1
+		}
+		if wanted {
+			jp.emit(start, i, tag)
+		}
+		return i
+	}
+}
+
+// str skips the string starting at i and returns the index after it.
+func (jp *jsonParser) str(i int) int {
+	if i >= len(jp.b) || jp.b[i] != '"' {
+		return -1
+	}
+	for i++; i < len(jp.b); i++ {
+		switch jp.b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+func (jp *jsonParser) key(start, end int) string {
+	raw := jp.b[start:end]
+	for _, c := range raw {
+		if c == '\\' {
+			var key string
+			json.Unmarshal(raw, &key)
+			return key
+		}
+	}
+	return string(raw[1 : len(raw)-1])
+}
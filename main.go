@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var doMake, doTest, recursion bool
+var suffixMode, runeStarts bool
 var caseSensitive bool
 var directory, indexFile string
-var pattern string
+var pattern, preset string
+var csvMode, tsvMode bool
+var columns, jsonPaths string
+var prettyJSON bool
+var doQuery, byFile bool
+var rangeFrom, rangeTo string
+var fileGlob, fileRegex string
+var exclusive, numericMode bool
+var doTerms, doVerify bool
+var reverseTerms, compressPositions bool
 var coworkers int
+var fuzzy = -1
+var suggest int
+var inlineBytes int
+var maxMapped = -1
+var maxOpen = 256
+var searchTimeout string
 
 func parseArgs() (ok bool) {
 	var dir *string
@@ -29,12 +51,76 @@ func parseArgs() (ok bool) {
 				dir = &directory
 			case "-i", "--index":
 				dir = &indexFile
+			case "-s", "--split":
+				dir = &preset
+			case "--columns":
+				dir = &columns
+			case "--csv":
+				csvMode = true
+			case "--tsv":
+				tsvMode = true
+			case "--json":
+				dir = &jsonPaths
+			case "--pretty":
+				prettyJSON = true
+			case "-q", "--query":
+				doQuery = true
+			case "--by-file":
+				byFile = true
+			case "--from":
+				dir = &rangeFrom
+			case "--to":
+				dir = &rangeTo
+			case "--file-glob":
+				dir = &fileGlob
+			case "--file-regex":
+				dir = &fileRegex
+			case "-l", "--files-with-matches":
+				summaryMode = "files"
+			case "--count-per-file":
+				summaryMode = "count"
+			case "--histogram":
+				summaryMode = "histogram"
+			case "--sort":
+				dir = &sortOrder
+			case "--sort=position", "--sort=term":
+				sortOrder = v[len("--sort="):]
+			case "--exclusive":
+				exclusive = true
+			case "--numeric":
+				numericMode = true
+			case "--compress":
+				compressPositions = true
+			case "--reverse":
+				reverseTerms = true
+			case "--verify":
+				doVerify = true
+			case "--terms":
+				doTerms = true
 			case "-j", "--co":
 				dirInt = &coworkers
+			case "--gap":
+				dirInt = &phraseGap
+			case "--fuzzy":
+				dirInt = &fuzzy
+			case "--inline":
+				dirInt = &inlineBytes
+			case "--suggest":
+				dirInt = &suggest
+			case "--max-mapped":
+				dirInt = &maxMapped
+			case "--max-open":
+				dirInt = &maxOpen
+			case "--timeout":
+				dir = &searchTimeout
 			case "-m", "--make":
 				doMake = true
 			case "-t", "--test":
 				doTest = true
+			case "-S", "--suffix":
+				suffixMode = true
+			case "--runes":
+				runeStarts = true
 			case "-r":
 				recursion = true
 			case "-c":
@@ -49,51 +135,165 @@ func parseArgs() (ok bool) {
 	return dir == nil && dirInt == nil
 }
 func usage() {
-	printf("Usage: %s [-r] [-cC] [-d directory] [-i index file] search\n", os.Args[0])
-	printf("       %s -m [-r] [-d directory] [-i index file] pattern\n", os.Args[0])
+	printf("Usage: %s [-r] [-cC] [--pretty] [--sort=term|position] [--timeout 5s] [--max-mapped N] [-d directory] [-i index file] search|glob\n", os.Args[0])
+	printf("       %s --verify [-d directory] [-i index file]\n", os.Args[0])
+	printf("       %s --terms [-d directory] [-i index file] [prefix]\n", os.Args[0])
+	printf("       %s --suggest K [-d directory] [-i index file] [prefix]\n", os.Args[0])
+	printf("       %s --fuzzy N [-d directory] [-i index file] search\n", os.Args[0])
+	printf("       %s -q [--by-file] [--gap n] [-d directory] [-i index file] query\n", os.Args[0])
+	printf("       %s --from A [--to B [--exclusive]] [-d directory] [-i index file]\n", os.Args[0])
+	printf("       %s -m [-r] [--numeric] [--reverse] [--compress] [--inline N] [-d directory] [-i index file] pattern\n", os.Args[0])
+	printf("       %s -m [-r] [--reverse] [--compress] [--inline N] [-d directory] [-i index file] -s preset\n", os.Args[0])
+	printf("       %s -m -S [--runes] [--compress] [--inline N] [-d directory] [-i index file]\n", os.Args[0])
+	printf("       %s -m --csv|--tsv --columns name,3,... [-d directory] [-i index file]\n", os.Args[0])
+	printf("       %s -m --json key.path,... [-d directory] [-i index file]\n", os.Args[0])
 	printf("       %s -t [-r] [-d directory] pattern\n", os.Args[0])
+	printf("\npresets: %s\n", strings.Join(PresetNames(), ", "))
+	printf("summary: -l/--files-with-matches, --count-per-file, --histogram with any search\n")
+	printf("files:   --max-open N files open, --max-mapped N files mapped at once (256 for searches, builds only stay under vm.max_map_count; 0 for no limit)\n")
+	printf("filter:  --file-glob 'api-*.log', --file-regex '^(api|web)-' with any search\n")
+	printf("glob:    err*timeout, user_??7, *.example.com (\\* and \\? for literal)\n")
+	printf("query:   alice AND error, a OR b, -debug, NOT x, (a OR b) c, \"a phrase\", a NEAR/5 b\n")
 }
 
-func main() {
-	if parseArgs() {
-		if doMake && !doTest && pattern != "" {
-			if directory == "" {
-				directory = "./"
-			}
+func defaultPaths() {
+	if directory == "" {
+		directory = "./"
+	}
 
-			if indexFile == "" {
-				if directory[len(directory)-1] == '/' {
-					indexFile = directory + ".index"
-				} else {
-					indexFile = directory + "/.index"
-				}
-			}
+	if indexFile == "" {
+		if directory[len(directory)-1] == '/' {
+			indexFile = directory + ".index"
+		} else {
+			indexFile = directory + "/.index"
+		}
+	}
+}
+
+var errNoSpliter = errors.New("no spliter")
+
+// newSpliter picks the entry source from exactly one of pattern, preset,
+// --csv/--tsv and --json.
+func newSpliter() (*WordSpliter, error) {
+	fields := csvMode || tsvMode || jsonPaths != ""
+	switch {
+	case csvMode && !tsvMode && jsonPaths == "" && pattern == "" && preset == "":
+		return NewFieldSpliter(',', columns)
+	case tsvMode && !csvMode && jsonPaths == "" && pattern == "" && preset == "":
+		return NewFieldSpliter('\t', columns)
+	case jsonPaths != "" && !csvMode && !tsvMode && pattern == "" && preset == "":
+		return NewJSONSpliter(jsonPaths)
+	case fields || (pattern != "") == (preset != ""):
+		return nil, errNoSpliter
+	case preset != "":
+		return NewPresetSpliter(preset)
+	}
+	return NewWordSpliter(pattern)
+}
 
-			makeIndex(directory, indexFile, pattern)
+func main() {
+	// the first interrupt stops the build or search, cleaning up its
+	// temporary files; a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	run(ctx)
+	if ctx.Err() != nil && exitStatus == 0 {
+		exitStatus = 130
+	}
+	stop()
+	os.Exit(exitStatus)
+}
+func run(ctx context.Context) {
+	if parseArgs() && (sortOrder == "" || sortOrder == "term" || sortOrder == "position") {
+		if !doMake && searchTimeout != "" {
+			d, err := time.ParseDuration(searchTimeout)
+			if handleErr(err) { return }
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		if doMake && (inlineBytes < 0 || inlineBytes > inlineMax) {
+			handleErr(errInlineSize)
+			return
+		}
+		if doMake && inlineBytes > 0 && numericMode {
+			handleErr(errInlineNumeric)
+			return
+		}
+		if doMake && !doTest && suffixMode && pattern == "" && preset == "" {
+			defaultPaths()
+			makeSuffixIndex(ctx, directory, indexFile, runeStarts, compressPositions, inlineBytes)
 			return
 		}
+		if doMake && !doTest && !suffixMode {
+			ws, err := newSpliter()
+			if err == nil {
+				if numericMode {
+					ws.Meta["order"] = "numeric"
+				}
+				if reverseTerms {
+					ws.Meta["reverse"] = "1"
+				}
+				if compressPositions {
+					ws.Meta["positions"] = "blocks"
+				}
+				if inlineBytes > 0 {
+					ws.Meta["inline"] = strconv.Itoa(inlineBytes)
+				}
+				defaultPaths()
+				makeIndex(ctx, directory, indexFile, ws)
+				return
+			}
+			if err != errNoSpliter {
+				handleErr(err)
+				return
+			}
+		}
 		if doTest && !doMake && pattern != "" {
 
 			printf("not implements\n")
 			return
 		}
-		if !doMake && !doTest && pattern != "" {
-			if directory == "" {
-				directory = "./"
-			}
-
-			if indexFile == "" {
-				if directory[len(directory)-1] == '/' {
-					indexFile = directory + ".index"
-				} else {
-					indexFile = directory + "/.index"
-				}
+		if doQuery && !doMake && !doTest && pattern != "" {
+			defaultPaths()
+			searchQuery(ctx, directory, indexFile, pattern, byFile)
+			return
+		}
+		if !doMake && !doTest && doVerify {
+			defaultPaths()
+			if verifyIndex(ctx, directory, indexFile) > 0 {
+				exitStatus = 1
 			}
-
-			searchIndex(directory, indexFile, []byte(pattern))
+			return
+		}
+		if !doMake && !doTest && !doQuery && doTerms {
+			defaultPaths()
+			listTerms(ctx, directory, indexFile, []byte(pattern))
+			return
+		}
+		if !doMake && !doTest && !doQuery && suggest > 0 {
+			defaultPaths()
+			searchSuggest(ctx, directory, indexFile, []byte(pattern), suggest)
+			return
+		}
+		if !doMake && !doTest && !doQuery && fuzzy >= 0 && pattern != "" {
+			defaultPaths()
+			searchFuzzy(ctx, directory, indexFile, []byte(pattern), fuzzy)
+			return
+		}
+		if !doMake && !doTest && !doQuery && pattern == "" && (rangeFrom != "" || rangeTo != "") {
+			defaultPaths()
+			searchRange(ctx, directory, indexFile, rangeFrom, rangeTo, exclusive)
+			return
+		}
+		if !doMake && !doTest && pattern != "" {
+			defaultPaths()
+			searchIndex(ctx, directory, indexFile, []byte(pattern))
 			return
 		}
 	}
 	usage()
 }
-
@@ -1,31 +1,33 @@
 package main
 
 import (
-	"os"
-	"sort"
+	"bytes"
+	"context"
+	"strconv"
+	"sync/atomic"
 	"io"
 	"time"
 )
 
-func makeIndex(base string, outfile string, pattern string) {
-	ws, err := NewWordSpliter(pattern)
-	if handleErr(err) { return }
-
+func makeIndex(ctx context.Context, base string, outfile string, ws *WordSpliter) {
 	printf("Index Output: %s\n", outfile)
-	indexFile, err := os.Create(outfile)
+	indexFile, err := createIndex(outfile)
 	if handleErr(err) { return }
-	defer indexFile.Close()
+	defer indexFile.Abort()
 
 	printf("Source: %s\n", base)
 	f, err := NewFileGroupDirectory(base)
 	if handleErr(err) { return }
 	defer f.Close()
+	f.SetHandleLimit(maxOpen)
+	f.SetMapLimit(mapLimit(true))
 	ws.ByteTotal = f.Size()
 
 	StatFunc("Measure", ws, func() {
-		err = ws.MeasureMulit(f, coworkers)
+		err = ws.MeasureMulit(ctx, f, coworkers)
 		handleErr(err)
 	})
+	if err != nil { return }
 
 	_, posMax := ws.PosStat()
 	_, wordMax := ws.WordStat()
@@ -41,68 +43,155 @@ func makeIndex(base string, outfile string, pattern string) {
 	_, err = f.Seek(0, 0)
 	if handleErr(err) { return }
 	index := NewIndex(ws.EntryCount(), indexDatStruct, f)
+	if ws.TagBits > 0 {
+		index.EnableTags()
+	}
+	if ws.Meta["order"] == "numeric" {
+		index.compare = compareNumeric
+	}
 
 	StatFunc("Read", ws, func() {
-		err = ws.ReadIntoIndexMulit(f, index, coworkers)
+		err = ws.ReadIntoIndexMulit(ctx, f, index, coworkers)
 		handleErr(err)
 	})
+	if err != nil { return }
+
+	inline := ws.Meta.Int("inline")
+	if inline > 0 {
+		printf("Load Prefixes ...\n")
+		index.LoadPrefixes(inline)
+	}
 
 	StatFunc("Sorting", index, func() {
-		sort.Sort(index)
-	})
-/*
-	var isSort bool
-	StatFunc("Checking", index, func() {
-		isSort = sort.IsSorted(index)
+		err = sortContext(ctx, index)
 	})
-	if !isSort {
-		handleErrStr("check failed")
-		return
+	if handleErr(err) { return }
+	var lenBits uint
+	if ws.Meta["reverse"] == "1" {
+		lenBits = tagBitsFor(wordMax + 1)
+		ws.Meta["lenbits"] = strconv.Itoa(int(lenBits))
 	}
-*/
 	printf("Write Index ...")
-	indexFile.Write([]byte("INDEX"))
-	indexFile.Write(f.DumpHead())
+	if handleErr(writeIndexHead(indexFile, f, ws.Meta)) { return }
+	streamStart, err := indexFile.Seek(0, 1)
+	if handleErr(err) { return }
+
+	dict, dictWordMax := BuildDict(index)
+	sortRuns(index, dict)
 
 	indexW := new(indexWriter)
 	StatFunc("WriteOut", indexW, func() {
-		indexW.DoWrite(indexFile, index, posBits)
+		if ws.Meta["positions"] == "blocks" {
+			err = indexW.DoWriteBlocks(ctx, indexFile, index, posBits, ws.TagBits)
+		} else {
+			err = indexW.DoWrite(ctx, indexFile, index, posBits, ws.TagBits)
+		}
 	})
+	if handleErr(err) { return }
+	streamEnd, err := indexFile.Seek(0, 1)
+	if handleErr(err) { return }
+
+	printf("Write Terms ... %d\n", len(dict))
+	if handleErr(writeSection(indexFile, "DICT", DumpDict(dict, index.Len(), dictWordMax))) { return }
+
+	if ws.Meta["order"] != "numeric" {
+		k := skipInterval(len(dict))
+		if handleErr(writeSection(indexFile, "SKIP", DumpSkip(termSamples(index, dict, k), k))) { return }
+	}
+
+	if inline > 0 {
+		printf("Write Prefixes ...\n")
+		pref, err := DumpPrefixes(index.Len(), inline, func(i int) ([]byte, bool, error) {
+			return termPrefix(index, i, inline)
+		})
+		if handleErr(err) { return }
+		if handleErr(writeSection(indexFile, "PREF", pref)) { return }
+	}
+
+	if lenBits > 0 {
+		index.prefixes = nil
+		index.compare = compareReversed
+		StatFunc("Sorting Reversed", index, func() {
+			err = sortContext(ctx, index)
+		})
+		if handleErr(err) { return }
+		buf := new(bytes.Buffer)
+		StatFunc("WriteOut Reversed", indexW, func() {
+			err = indexW.DoWrite(ctx, buf, reversedList{ index, ws.TagBits }, posBits, lenBits + ws.TagBits)
+		})
+		if handleErr(err) { return }
+		if handleErr(writeSection(indexFile, "RVRS", buf.Bytes())) { return }
+	}
+
+	printf("Write Checksums ...\n")
+	if handleErr(writeSums(indexFile.File, streamStart, streamEnd)) { return }
+	if handleErr(ctx.Err()) { return }
+	handleErr(indexFile.Commit())
 }
 
+type positionList interface {
+	Len() int
+	GetPos(i int) int64
+}
+
+type taggedList interface {
+	positionList
+	GetTag(i int) int
+}
+
+// indexWriter counts the entries written, atomically as StatFunc prints them
+// from its own goroutine.
 type indexWriter struct {
-	entryCount     int
-	lastEntryCount int
+	entryCount     int64
+	lastEntryCount int64
 	entryTotal     int
 }
-func (iw *indexWriter) DoWrite(file io.Writer, index *Index, posBits uint) {
+// DoWrite writes the entries, each a position followed by a tagBits wide tag
+// when tagBits is not 0.
+func (iw *indexWriter) DoWrite(ctx context.Context, file io.Writer, index positionList, posBits, tagBits uint) error {
 	iw.entryTotal = index.Len()
+	tagged, _ := index.(taggedList)
 	bw := NewBitWriter(file)
-	bw.Write(uint64(posBits), 8)
-	bw.Write(uint64(index.Len()), 56)
+	if err := bw.Write(uint64(posBits), 8); err != nil {
+		return err
+	}
+	if err := bw.Write(uint64(index.Len()), 56); err != nil {
+		return err
+	}
 	for i := 0; i < index.Len(); i++ {
-		bw.Write(uint64(index.GetPos(i)), posBits)
-		iw.entryCount = i + 1
+		if i & 0xFFFF == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := bw.Write(uint64(index.GetPos(i)), posBits); err != nil {
+			return err
+		}
+		if tagBits > 0 {
+			if err := bw.Write(uint64(tagged.GetTag(i)), tagBits); err != nil {
+				return err
+			}
+		}
+		atomic.StoreInt64(&iw.entryCount, int64(i + 1))
 	}
-	bw.Close()
+	return bw.Close()
 }
 func (iw *indexWriter) ResetStat() {
 	iw.lastEntryCount = 0
 }
 func (iw *indexWriter) PrintStat(d time.Duration, last bool) {
+	entryCount := atomic.LoadInt64(&iw.entryCount)
 	var entrySpeed float64
 	var entrySpeedUnit string
 	if last {
-		entrySpeed, entrySpeedUnit = FormatUnit(float64(iw.entryCount) / d.Seconds())
+		entrySpeed, entrySpeedUnit = FormatUnit(float64(entryCount) / d.Seconds())
 	} else {
-		entrySpeed, entrySpeedUnit = FormatUnit(float64(iw.entryCount - iw.lastEntryCount) / d.Seconds())
+		entrySpeed, entrySpeedUnit = FormatUnit(float64(entryCount - iw.lastEntryCount) / d.Seconds())
 	}
 	percentage := float64(100)
 	if !last {
-		percentage = (float64(iw.entryCount) / float64(iw.entryTotal) * 100)
+		percentage = (float64(entryCount) / float64(iw.entryTotal) * 100)
 	}
 	printf("Entry: %12d(%6.1f%s/s) [%5.1f%%]",
-		iw.entryCount,
+		entryCount,
 		entrySpeed, entrySpeedUnit,
 		percentage)
 
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	queryTerm = iota
+	queryAnd
+	queryOr
+	queryNot
+	queryPhrase
+	queryNear
+)
+
+// queryNode is a node of a parsed query: a term, or an operator over kids.
+type queryNode struct {
+	op   int
+	term []byte
+	dist int
+	kids []*queryNode
+}
+
+// phraseGap is the most bytes allowed between the words of a phrase, and
+// nearDist the distance of a NEAR without /n.
+var phraseGap = 1
+const nearDist = 16
+
+var errQuerySyntax = errors.New("query syntax error")
+var errQueryNegative = errors.New("query needs a term that is not negated")
+
+// ParseQuery parses terms joined by AND (or nothing), OR and NOT / a leading
+// '-', with parentheses for grouping. Double quotes hold a term with spaces,
+// or a phrase when it has several words; "a NEAR/n b" matches a and b on one
+// line at most n bytes apart. NEAR binds tighter than AND, AND than OR.
+func ParseQuery(s string) (*queryNode, error) {
+	qp := &queryParser{ tokens: queryTokens(s) }
+	node, err := qp.or()
+	if err != nil {
+		return nil, err
+	}
+	if qp.i < len(qp.tokens) {
+		return nil, errQuerySyntax
+	}
+	return node, nil
+}
+
+func queryTokens(s string) (tokens []string) {
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '"' || c == '-' && i+1 < len(s) && s[i+1] == '"':
+			start := i
+			if c == '-' {
+				i++
+			}
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end + 2
+			}
+			tokens = append(tokens, s[start:i])
+		default:
+			start := i
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' && s[i] != '(' && s[i] != ')' {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+	return
+}
+
+type queryParser struct {
+	tokens []string
+	i      int
+}
+
+func (qp *queryParser) peek() string {
+	if qp.i < len(qp.tokens) {
+		return qp.tokens[qp.i]
+	}
+	return ""
+}
+func (qp *queryParser) or() (*queryNode, error) {
+	node := &queryNode{ op: queryOr }
+	for {
+		kid, err := qp.and()
+		if err != nil {
+			return nil, err
+		}
+		node.kids = append(node.kids, kid)
+		if qp.peek() != "OR" {
+			break
+		}
+		qp.i++
+	}
+	if len(node.kids) == 1 {
+		return node.kids[0], nil
+	}
+	return node, nil
+}
+func (qp *queryParser) and() (*queryNode, error) {
+	node := &queryNode{ op: queryAnd }
+	for {
+		kid, err := qp.near()
+		if err != nil {
+			return nil, err
+		}
+		node.kids = append(node.kids, kid)
+		switch qp.peek() {
+		case "AND":
+			qp.i++
+			continue
+		case "", "OR", ")":
+		default:
+			continue
+		}
+		break
+	}
+	if len(node.kids) == 1 {
+		return node.kids[0], nil
+	}
+	return node, nil
+}
+func (qp *queryParser) near() (*queryNode, error) {
+	node, err := qp.unary()
+	for err == nil && strings.HasPrefix(qp.peek(), "NEAR") {
+		dist := nearDist
+		if tok := qp.peek(); tok != "NEAR" {
+			dist, err = strconv.Atoi(strings.TrimPrefix(tok, "NEAR/"))
+			if err != nil || dist < 0 {
+				return nil, errQuerySyntax
+			}
+		}
+		qp.i++
+		var kid *queryNode
+		kid, err = qp.unary()
+		if err == nil && (!node.positional() || !kid.positional()) {
+			err = errQuerySyntax
+		}
+		node = &queryNode{ op: queryNear, dist: dist, kids: []*queryNode{ node, kid } }
+	}
+	return node, err
+}
+func (node *queryNode) positional() bool {
+	return node.op == queryTerm || node.op == queryPhrase || node.op == queryNear
+}
+func (qp *queryParser) unary() (*queryNode, error) {
+	tok := qp.peek()
+	switch {
+	case tok == "" || tok == ")" || tok == "AND" || tok == "OR" || strings.HasPrefix(tok, "NEAR"):
+		return nil, errQuerySyntax
+	case tok == "NOT":
+		qp.i++
+		kid, err := qp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{ op: queryNot, kids: []*queryNode{ kid } }, nil
+	case tok == "(":
+		qp.i++
+		node, err := qp.or()
+		if err != nil {
+			return nil, err
+		}
+		if qp.peek() != ")" {
+			return nil, errQuerySyntax
+		}
+		qp.i++
+		return node, nil
+	case len(tok) > 1 && tok[0] == '-':
+		qp.tokens[qp.i] = tok[1:]
+		kid, err := qp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{ op: queryNot, kids: []*queryNode{ kid } }, nil
+	}
+	qp.i++
+	if tok[0] == '"' {
+		words := strings.Fields(strings.TrimSuffix(tok[1:], "\""))
+		if len(words) == 0 {
+			return nil, errQuerySyntax
+		}
+		if len(words) > 1 {
+			node := &queryNode{ op: queryPhrase }
+			for _, w := range words {
+				node.kids = append(node.kids, &queryNode{ op: queryTerm, term: []byte(w) })
+			}
+			return node, nil
+		}
+		tok = words[0]
+	}
+	return &queryNode{ op: queryTerm, term: []byte(tok) }, nil
+}
+
+type queryHit struct {
+	offset int64
+	length int
+}
+
+// querySpan is a match of a positional node, from offset to end, made of
+// the term hits to highlight.
+type querySpan struct {
+	offset, end int64
+	parts       []queryHit
+}
+type querySpans []querySpan
+
+func (s querySpans) Len() int           { return len(s) }
+func (s querySpans) Less(i, j int) bool { return s[i].offset < s[j].offset }
+func (s querySpans) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// queryEval evaluates a query at line granularity, or per file when byFile
+// is set. Sets are sorted keys: line start offsets or file indexes.
+type queryEval struct {
+	ir     *IndexReader
+	byFile bool
+	hits   map[int64][]queryHit
+}
+
+func (qe *queryEval) key(offset int64) (int64, error) {
+	if qe.byFile {
+		return int64(qe.ir.f.OffsetIndex(offset)), nil
+	}
+	return qe.ir.LineStart(offset)
+}
+func (qe *queryEval) eval(node *queryNode) ([]int64, error) {
+	switch node.op {
+	case queryTerm, queryPhrase, queryNear:
+		spans, err := qe.spans(node)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]int64, 0, len(spans))
+		for _, span := range spans {
+			key, err := qe.key(span.offset)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			qe.hits[key] = append(qe.hits[key], span.parts...)
+		}
+		sort.Sort(int64Slice(keys))
+		return uniqueSorted(keys), nil
+	case queryOr:
+		var keys []int64
+		for _, kid := range node.kids {
+			if kid.op == queryNot {
+				return nil, errQueryNegative
+			}
+			k, err := qe.eval(kid)
+			if err != nil {
+				return nil, err
+			}
+			keys = unionSorted(keys, k)
+		}
+		return keys, nil
+	case queryAnd:
+		var keys []int64
+		first := true
+		for _, kid := range node.kids {
+			if kid.op == queryNot {
+				continue
+			}
+			k, err := qe.eval(kid)
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				keys, first = k, false
+			} else {
+				keys = intersectSorted(keys, k)
+			}
+		}
+		if first {
+			return nil, errQueryNegative
+		}
+		for _, kid := range node.kids {
+			if kid.op != queryNot || len(keys) == 0 {
+				continue
+			}
+			k, err := qe.eval(kid.kids[0])
+			if err != nil {
+				return nil, err
+			}
+			keys = subtractSorted(keys, k)
+		}
+		return keys, nil
+	}
+	return nil, errQueryNegative
+}
+
+// spans returns the matches of a positional node sorted by offset.
+func (qe *queryEval) spans(node *queryNode) (querySpans, error) {
+	switch node.op {
+	case queryTerm:
+		offsets, err := qe.ir.Lookup(node.term)
+		if err != nil {
+			return nil, err
+		}
+		spans := make(querySpans, len(offsets))
+		for i, offset := range offsets {
+			hit := queryHit{ offset, len(node.term) }
+			spans[i] = querySpan{ offset, offset + int64(hit.length), []queryHit{ hit } }
+		}
+		sort.Sort(spans)
+		return spans, nil
+	case queryPhrase:
+		spans, err := qe.spans(node.kids[0])
+		for _, kid := range node.kids[1:] {
+			if err != nil || len(spans) == 0 {
+				break
+			}
+			var next querySpans
+			next, err = qe.spans(kid)
+			if err == nil {
+				spans, err = qe.follow(spans, next)
+			}
+		}
+		return spans, err
+	case queryNear:
+		a, err := qe.spans(node.kids[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := qe.spans(node.kids[1])
+		if err != nil {
+			return nil, err
+		}
+		return qe.near(a, b, int64(node.dist))
+	}
+	return nil, errQuerySyntax
+}
+
+// sameLine reports whether no line break lies in [start, end).
+func (qe *queryEval) sameLine(start, end int64) (bool, error) {
+	for start < end {
+		str, err := qe.ir.f.ReadAt(start, qe.ir.buf[0:min(len(qe.ir.buf), int(end - start))])
+		if err != nil {
+			return false, err
+		}
+		if len(str) == 0 || bytes.IndexByte(str, '\n') >= 0 {
+			return false, nil
+		}
+		start += int64(len(str))
+	}
+	return true, nil
+}
+
+// follow joins every span of a with the span of b starting 1 to phraseGap
+// bytes after it on the same line.
+func (qe *queryEval) follow(a, b querySpans) (querySpans, error) {
+	var out querySpans
+	for _, x := range a {
+		j := sort.Search(len(b), func(j int) bool { return b[j].offset > x.end })
+		if j == len(b) || b[j].offset > x.end + int64(phraseGap) {
+			continue
+		}
+		ok, err := qe.sameLine(x.end, b[j].offset)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			hit := queryHit{ x.offset, int(b[j].end - x.offset) }
+			out = append(out, querySpan{ x.offset, b[j].end, []queryHit{ hit } })
+		}
+	}
+	return out, nil
+}
+
+// near pairs spans of a and b that do not overlap, lie on the same line and
+// have at most dist bytes between them.
+func (qe *queryEval) near(a, b querySpans, dist int64) (querySpans, error) {
+	var maxLen int64
+	for _, y := range b {
+		if y.end - y.offset > maxLen { maxLen = y.end - y.offset }
+	}
+	var out querySpans
+	for _, x := range a {
+		j := sort.Search(len(b), func(j int) bool { return b[j].offset >= x.offset - dist - maxLen })
+		for ; j < len(b) && b[j].offset <= x.end + dist; j++ {
+			y := b[j]
+			start, end := y.end, x.offset
+			if x.end <= y.offset {
+				start, end = x.end, y.offset
+			}
+			if end < start || end - start > dist {
+				continue
+			}
+			ok, err := qe.sameLine(start, end)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				span := querySpan{ x.offset, x.end, append(append([]queryHit{}, x.parts...), y.parts...) }
+				if y.offset < span.offset { span.offset = y.offset }
+				if y.end > span.end { span.end = y.end }
+				out = append(out, span)
+			}
+		}
+	}
+	sort.Sort(out)
+	return out, nil
+}
+
+func searchQuery(ctx context.Context, base, index, query string, byFile bool) {
+	node, err := ParseQuery(query)
+	if handleErr(err) { return }
+
+	ir, err := OpenIndex(ctx, base, index)
+	if handleErr(err) { return }
+	defer ir.Close()
+
+	qe := &queryEval{ ir: ir, byFile: byFile, hits: make(map[int64][]queryHit) }
+	keys, err := qe.eval(node)
+	if handleErr(err) { return }
+
+	if byFile {
+		for _, key := range keys {
+			if !ir.InFiles(ir.f.FileOffset(int(key))) {
+				continue
+			}
+			filename, _ := ir.f.Filename(ir.f.FileOffset(int(key)))
+			fmt.Fprintf(os.Stdout, "%s\n", filename)
+		}
+		return
+	}
+	defer ir.PrintSummary()
+	for _, key := range keys {
+		if !ir.InFiles(key) {
+			continue
+		}
+		if ir.summary != nil {
+			if handleErr(ir.summarize(key)) { return }
+			continue
+		}
+		if handleErr(ir.PrintLine(key, qe.hits[key])) { return }
+	}
+}
+
+// PrintLine prints the line starting at start with the hits on it
+// highlighted.
+func (ir *IndexReader) PrintLine(start int64, hits []queryHit) error {
+	if err := ir.ctx.Err(); err != nil {
+		return err
+	}
+	line, err := ir.ReadLine(start)
+	if err != nil {
+		return err
+	}
+	marks := make([]bool, len(line))
+	for _, h := range hits {
+		for i := h.offset - start; i < h.offset - start + int64(h.length) && i < int64(len(line)); i++ {
+			if i >= 0 {
+				marks[i] = true
+			}
+		}
+	}
+	out := make([]byte, 0, len(line) + 16)
+	for i, c := range line {
+		if marks[i] && (i == 0 || !marks[i-1]) {
+			out = append(out, "\033[32m"...)
+		}
+		out = append(out, c)
+		if marks[i] && (i == len(line)-1 || !marks[i+1]) {
+			out = append(out, "\033[0m"...)
+		}
+	}
+	filename, _ := ir.f.Filename(start)
+	fmt.Fprintf(os.Stdout, "%s: %s\n", filename, out)
+	return nil
+}
+
+func uniqueSorted(a []int64) []int64 {
+	n := 0
+	for i, v := range a {
+		if i == 0 || v != a[n-1] {
+			a[n] = v
+			n++
+		}
+	}
+	return a[0:n]
+}
+func unionSorted(a, b []int64) []int64 {
+	out := make([]int64, 0, len(a) + len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j >= len(b) || i < len(a) && a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case i >= len(a) || b[j] < a[i]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+func subtractSorted(a, b []int64) []int64 {
+	n, j := 0, 0
+	for _, v := range a {
+		for j < len(b) && b[j] < v {
+			j++
+		}
+		if j < len(b) && b[j] == v {
+			continue
+		}
+		a[n] = v
+		n++
+	}
+	return a[0:n]
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// showQuery prints a parsed query as an S-expression.
+func showQuery(node *queryNode) string {
+	var kids []string
+	for _, kid := range node.kids {
+		kids = append(kids, showQuery(kid))
+	}
+	switch node.op {
+	case queryTerm:
+		return string(node.term)
+	case queryPhrase:
+		return `"` + strings.Join(kids, " ") + `"`
+	case queryAnd:
+		return "(AND " + strings.Join(kids, " ") + ")"
+	case queryOr:
+		return "(OR " + strings.Join(kids, " ") + ")"
+	case queryNot:
+		return "(NOT " + strings.Join(kids, " ") + ")"
+	case queryNear:
+		return fmt.Sprintf("(NEAR/%d %s)", node.dist, strings.Join(kids, " "))
+	}
+	return "?"
+}
+
+func TestParseQuery(t *testing.T) {
+	for q, want := range map[string]string{
+		"a":                   "a",
+		"a b":                 "(AND a b)",
+		"a AND b c":           "(AND a b c)",
+		"a OR b":              "(OR a b)",
+		// AND binds tighter than OR
+		"a OR b c":            "(OR a (AND b c))",
+		"a b OR c":            "(OR (AND a b) c)",
+		"a OR b AND c OR d":   "(OR a (AND b c) d)",
+		"(a OR b) c":          "(AND (OR a b) c)",
+		"((a))":               "a",
+		// negation applies to the next operand only
+		"-a b":                "(AND (NOT a) b)",
+		"NOT a OR b":          "(OR (NOT a) b)",
+		"NOT (a OR b)":        "(NOT (OR a b))",
+		"NOT NOT a":           "(NOT (NOT a))",
+		"a-b":                 "a-b",
+		// quotes hold a phrase, or a single term
+		`"a b" c`:             `(AND "a b" c)`,
+		`"a"`:                 "a",
+		`-"a b"`:              `(NOT "a b")`,
+		`"a  b`:               `"a b"`,
+		`"a OR b"`:            `"a OR b"`,
+		// NEAR binds tighter than AND, and to the left
+		"a NEAR b":            "(NEAR/16 a b)",
+		"a NEAR/3 b c":        "(AND (NEAR/3 a b) c)",
+		"a NEAR/0 b OR c":     "(OR (NEAR/0 a b) c)",
+		"a NEAR/3 b NEAR/5 c": "(NEAR/5 (NEAR/3 a b) c)",
+		`"a b" NEAR/2 c`:      `(NEAR/2 "a b" c)`,
+	} {
+		node, err := ParseQuery(q)
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		if got := showQuery(node); got != want {
+			t.Errorf("%s: parsed as %s, want %s", q, got, want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"",
+		`""`,
+		"a OR",
+		"OR a",
+		"AND a",
+		"NOT",
+		"(a",
+		"a)",
+		"()",
+		"a NEAR",
+		"NEAR a",
+		"a NEAR/x b",
+		"a NEAR/-1 b",
+		// NEAR only joins terms, phrases and other NEARs
+		"-a NEAR b",
+		"a NEAR NOT b",
+		"(a OR b) NEAR c",
+		"a NEAR (b c)",
+	} {
+		if node, err := ParseQuery(q); err != errQuerySyntax {
+			t.Errorf("%q: parsed as %v, %v", q, node, err)
+		}
+	}
+}
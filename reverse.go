@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+)
+
+// compareReversed orders terms by their bytes read from the end.
+func compareReversed(a, b []byte) int {
+	for i := 1; i <= len(a) && i <= len(b); i++ {
+		if a[len(a)-i] != b[len(b)-i] {
+			if a[len(a)-i] < b[len(b)-i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// reversedList writes the entries of a sorted index with the term length
+// above the tag, so the reversed section can be read like the main stream.
+type reversedList struct {
+	*Index
+	tagBits uint
+}
+
+func (rl reversedList) GetTag(i int) int {
+	_, length := rl.datStruct.Get(rl.dat, i)
+	tag := 0
+	if rl.tags != nil {
+		tag = rl.Index.GetTag(i)
+	}
+	return length << rl.tagBits | tag
+}
+
+var errNoReversed = errors.New("index has no reversed terms, rebuild it with --reverse")
+
+// reversedIndex is the "RVRS" section: the entries again, sorted by their
+// reversed term, each a position and lenBits of length above the tag.
+type reversedIndex struct {
+	br      *BitReader
+	posBits int64
+	lenBits int64
+	count   int64
+}
+
+func (ir *IndexReader) Reversed() (*reversedIndex, error) {
+	if ir.rev != nil {
+		return ir.rev, nil
+	}
+	sec, ok := ir.sections["RVRS"]
+	if !ok {
+		return nil, errNoReversed
+	}
+	rv := &reversedIndex{ br: NewBitReader(ir.fidx) }
+	rv.br.Base = sec.offset
+	v, err := rv.br.ReadAt(0, 8)
+	if err != nil {
+		return nil, err
+	}
+	rv.posBits = int64(v)
+	v, err = rv.br.ReadAt(8, 56)
+	if err != nil {
+		return nil, err
+	}
+	rv.count = int64(v)
+	rv.br.Base += 8
+	rv.lenBits = int64(ir.meta.Int("lenbits"))
+	ir.rev = rv
+	return rv, nil
+}
+
+// Entry returns the position, term length and tag of reversed entry i.
+func (rv *reversedIndex) Entry(i int64, tagBits int64) (pos int64, length, tag int, err error) {
+	bits := rv.posBits + rv.lenBits + tagBits
+	v, err := rv.br.ReadAt(i * bits, rv.posBits)
+	if err != nil {
+		return
+	}
+	pos = int64(v)
+	v, err = rv.br.ReadAt(i * bits + rv.posBits, rv.lenBits + tagBits)
+	return pos, int(v >> uint(tagBits)), int(v & (1 << uint(tagBits) - 1)), err
+}
+
+// SuffixRange returns the reversed entries [start, end) whose term ends
+// with q.
+func (ir *IndexReader) SuffixRange(q []byte) (start, end int64, err error) {
+	rv, err := ir.Reversed()
+	if err != nil {
+		return
+	}
+	if len(q) > len(ir.buf) {
+		q = q[len(q) - len(ir.buf):]
+	}
+	compare := func(i int64) (int, error) {
+		pos, length, _, err := rv.Entry(i, ir.tagBits)
+		if err != nil {
+			return 0, err
+		}
+		// only the tail of the term that can meet q is read
+		n := min(length, len(q))
+		str, err := ir.f.ReadAt(pos + int64(length - n), ir.buf[0:n])
+		if err != nil {
+			return 0, err
+		}
+		c := compareReversed(str, q[len(q) - len(str):])
+		if c == 0 && len(str) < len(q) {
+			c = -1
+		}
+		return c, nil
+	}
+	start, err = bsearch(rv.count, func(i int64) (bool, error) {
+		c, err := compare(i)
+		return c >= 0, err
+	})
+	if err != nil {
+		return
+	}
+	end, err = bsearch(rv.count - start, func(i int64) (bool, error) {
+		c, err := compare(start + i)
+		return c > 0, err
+	})
+	end += start
+	return
+}
@@ -0,0 +1,166 @@
+package main
+
+import "context"
+
+// sais builds the suffix array of t, whose symbols are in [0, k), into sa
+// using the SA-IS algorithm (Nong, Zhang & Chan). The end of t acts as a
+// virtual sentinel smaller than every symbol. The passes check ctx every 1M
+// steps and give up with its error, leaving sa unusable.
+func sais(ctx context.Context, t []int32, sa []int32, k int) error {
+	n := len(t)
+	if n == 0 {
+		return nil
+	}
+	if n == 1 {
+		sa[0] = 0
+		return nil
+	}
+	canceled := func(i int) bool {
+		return i & 0xFFFFF == 0 && ctx.Err() != nil
+	}
+
+	stype := make([]bool, n)
+	for i := n - 2; i >= 0; i-- {
+		if canceled(i) {
+			return ctx.Err()
+		}
+		stype[i] = t[i] < t[i+1] || t[i] == t[i+1] && stype[i+1]
+	}
+	isLMS := func(i int) bool {
+		return i > 0 && stype[i] && !stype[i-1]
+	}
+	bkt := make([]int32, k)
+	buckets := func(end bool) {
+		for i := range bkt {
+			bkt[i] = 0
+		}
+		for _, c := range t {
+			bkt[c]++
+		}
+		var sum int32
+		for i, c := range bkt {
+			sum += c
+			if end {
+				bkt[i] = sum
+			} else {
+				bkt[i] = sum - c
+			}
+		}
+	}
+	induce := func() error {
+		buckets(false)
+		sa[bkt[t[n-1]]] = int32(n - 1)
+		bkt[t[n-1]]++
+		for i := 0; i < n; i++ {
+			if canceled(i) {
+				return ctx.Err()
+			}
+			j := sa[i] - 1
+			if j >= 0 && !stype[j] {
+				sa[bkt[t[j]]] = j
+				bkt[t[j]]++
+			}
+		}
+		buckets(true)
+		for i := n - 1; i >= 0; i-- {
+			if canceled(i) {
+				return ctx.Err()
+			}
+			j := sa[i] - 1
+			if j >= 0 && stype[j] {
+				bkt[t[j]]--
+				sa[bkt[t[j]]] = j
+			}
+		}
+		return nil
+	}
+
+	// sort LMS substrings
+	for i := range sa {
+		sa[i] = -1
+	}
+	buckets(true)
+	for i := n - 1; i > 0; i-- {
+		if isLMS(i) {
+			bkt[t[i]]--
+			sa[bkt[t[i]]] = int32(i)
+		}
+	}
+	if err := induce(); err != nil {
+		return err
+	}
+
+	// name them, equal substrings share a name
+	m := 0
+	for i := 0; i < n; i++ {
+		if isLMS(int(sa[i])) {
+			sa[m] = sa[i]
+			m++
+		}
+	}
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+	name, prev := 0, -1
+	for i := 0; i < m; i++ {
+		if canceled(i) {
+			return ctx.Err()
+		}
+		pos := int(sa[i])
+		diff := prev < 0
+		for d := 0; !diff; d++ {
+			if pos+d == n || prev+d == n || t[pos+d] != t[prev+d] || stype[pos+d] != stype[prev+d] {
+				diff = true
+			} else if d > 0 && (isLMS(pos+d) || isLMS(prev+d)) {
+				break
+			}
+		}
+		if diff {
+			name++
+			prev = pos
+		}
+		sa[m+pos/2] = int32(name - 1)
+	}
+	j := n - 1
+	for i := n - 1; i >= m; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+
+	// sort the reduced string, recursing while names repeat
+	s1, sa1 := sa[n-m:], sa[:m]
+	if name < m {
+		if err := sais(ctx, s1, sa1, name); err != nil {
+			return err
+		}
+	} else {
+		for i, c := range s1 {
+			sa1[c] = int32(i)
+		}
+	}
+
+	// induce the full order from the sorted LMS suffixes
+	j = 0
+	for i := 1; i < n; i++ {
+		if isLMS(i) {
+			s1[j] = int32(i)
+			j++
+		}
+	}
+	for i := range sa1 {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+	buckets(true)
+	for i := m - 1; i >= 0; i-- {
+		p := sa[i]
+		sa[i] = -1
+		bkt[t[p]]--
+		sa[bkt[t[p]]] = p
+	}
+	return induce()
+}
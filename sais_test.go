@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// naiveSuffixArray sorts the suffixes of t by comparing them, a suffix
+// that is a prefix of another first.
+func naiveSuffixArray(t []int32) []int32 {
+	sa := make([]int32, len(t))
+	for i := range sa {
+		sa[i] = int32(i)
+	}
+	sort.Slice(sa, func(a, b int) bool {
+		x, y := t[sa[a]:], t[sa[b]:]
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if x[i] != y[i] {
+				return x[i] < y[i]
+			}
+		}
+		return len(x) < len(y)
+	})
+	return sa
+}
+
+func TestSAIS(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var inputs [][]int32
+	inputs = append(inputs, nil, []int32{ 5 }, []int32{ 0, 0 }, []int32{ 1, 0 })
+	// runs and periods, where the LMS substrings repeat and recursion goes deep
+	for _, period := range []int{ 1, 2, 3, 7 } {
+		t := make([]int32, 200)
+		for i := range t {
+			t[i] = int32(i % period)
+		}
+		inputs = append(inputs, t)
+	}
+	for _, k := range []int{ 1, 2, 3, 4, 257 } {
+		for n := 0; n < 300; n += 1 + n / 8 {
+			t := make([]int32, n)
+			for i := range t {
+				t[i] = int32(rnd.Intn(k))
+			}
+			inputs = append(inputs, t)
+		}
+	}
+
+	for _, in := range inputs {
+		sa := make([]int32, len(in))
+		if err := sais(context.Background(), in, sa, 257); err != nil {
+			t.Fatal(err)
+		}
+		want := naiveSuffixArray(in)
+		for i := range want {
+			if sa[i] != want[i] {
+				t.Fatalf("%v: suffix array %v, want %v", in, sa, want)
+			}
+		}
+	}
+}
@@ -1,75 +1,179 @@
 package main
 
 import (
-	"fmt"
-	"os"
-	"io"
-	"bytes"
+	"context"
+	"sort"
+	"unicode/utf8"
 )
 
-func searchIndex(base, index string, q []byte) {
-	fidx, err := os.Open(index)
+func searchIndex(ctx context.Context, base, index string, q []byte) {
+	ir, err := OpenIndex(ctx, base, index)
 	if handleErr(err) { return }
-	defer fidx.Close()
+	defer ir.Close()
+	defer ir.PrintSummary()
+	defer ir.PrintSorted()
 
-	buf5 := make([]byte, 5)
-	_, err = io.ReadFull(fidx, buf5)
-	if handleErr(err) { return }
-	if string(buf5) != "INDEX" {
-		handleErrStr("not index file")
+	if gq := compileGlob(q); gq != nil {
+		searchWildcard(ir, gq)
+		return
+	}
+	if gram := ir.meta.Int("gram"); gram > 0 && longestCJKRun(q) > gram {
+		hits, err := ir.SearchGrams(q, gram)
+		if handleErr(err) { return }
+		for _, offset := range hits {
+			if handleErr(ir.PrintHit(offset, len(q), "")) { return }
+		}
 		return
 	}
-	f, err := NewFileGroupReadHead(base, fidx)
-	if handleErr(err) { return }
-	defer f.Close()
 
-	br := NewBitReader(fidx)
-	br.Base, err = fidx.Seek(0, 1)
+	handleErr(ir.eachMatch(q, func(i int64, length int) error {
+		return ir.PrintEntry(i, length)
+	}))
+}
 
-	var v uint64
-	v, err = br.ReadAt(0, 8)
-	if handleErr(err) { return }
-	posBits := int64(v)
-	v, err = br.ReadAt(8, 56)
+// searchRange prints every entry between from and to, empty bounds are open.
+func searchRange(ctx context.Context, base, index, from, to string, exclusive bool) {
+	ir, err := OpenIndex(ctx, base, index)
 	if handleErr(err) { return }
-	indexNum := int64(v)
-	br.Base += 8
+	defer ir.Close()
+	defer ir.PrintSummary()
+	defer ir.PrintSorted()
 
-	buf := make([]byte, 4 * 1024)
-	if len(q) > len(buf) {
-		q = q[0:len(buf)]
+	var lo, hi []byte
+	if from != "" { lo = []byte(from) }
+	if to != "" { hi = []byte(to) }
+	start, end, err := ir.Between(lo, hi, exclusive)
+	if handleErr(err) { return }
+	for i := start; i < end; i++ {
+		if handleErr(ir.PrintEntry(i, 0)) { return }
 	}
-	ns, err := bsearch(indexNum, func(i int64) (bool, error) {
-		offset, err := br.ReadAt(i * posBits, posBits)
-		if handleErr(err) { return false, err }
+}
 
-		str, err := f.ReadAt(int64(offset), buf[0:len(q)])
-		if handleErr(err) { return false, err }
-		return bytes.Compare(str[0:lineEnd(str, 0)], q) >= 0, nil
+// Lookup returns the offsets of every entry matching q.
+func (ir *IndexReader) Lookup(q []byte) ([]int64, error) {
+	if gram := ir.meta.Int("gram"); gram > 0 && longestCJKRun(q) > gram {
+		return ir.SearchGrams(q, gram)
+	}
+	var offsets []int64
+	err := ir.eachMatch(q, func(i int64, length int) error {
+		offset, err := ir.Pos(i)
+		if err == nil {
+			offsets = append(offsets, offset)
+		}
+		return err
 	})
-	if err != nil { return }
-	for ; ns < indexNum; ns++ {
-		offset, err := br.ReadAt(ns * posBits, posBits)
-		if handleErr(err) { return }
+	return offsets, err
+}
 
-		base := (int64(offset) / 1024 - 1) * 1024
-		if (base < 0) { base = 0 }
+// SearchGrams finds q in an n-gram index: every n-gram of its CJK runs is
+// looked up, shifted back to where q would start and the candidate sets are
+// intersected. Survivors are checked against the source for the rest of q.
+func (ir *IndexReader) SearchGrams(q []byte, gram int) ([]int64, error) {
+	var hits []int64
+	first := true
+	for _, g := range queryGrams(q, gram) {
+		start, end, err := ir.Range(q[g[0]:g[1]])
+		if err != nil {
+			return nil, err
+		}
+		cand := make([]int64, 0, end - start)
+		for i := start; i < end; i++ {
+			offset, err := ir.Pos(i)
+			if err != nil {
+				return nil, err
+			}
+			if offset >= int64(g[0]) {
+				cand = append(cand, offset - int64(g[0]))
+			}
+		}
+		sort.Sort(int64Slice(cand))
+		if first {
+			hits, first = cand, false
+		} else {
+			hits = intersectSorted(hits, cand)
+		}
+		if len(hits) == 0 {
+			return nil, nil
+		}
+	}
 
-		str, err := f.ReadAt(base, buf)
-		if handleErr(err) { return }
-		offsetBuf := int(int64(offset) - base)
-		qEndBuf := offsetBuf + min(len(q), len(str))
-		if bytes.Compare(str[offsetBuf : qEndBuf], q) == 0 {
-			filename, _ := f.Filename(int64(offset))
-			lineLeft := str[lineStart(str, offsetBuf) : offsetBuf]
-			lineRight := str[qEndBuf : lineEnd(str, qEndBuf)]
+	n := 0
+	buf := make([]byte, len(q))
+	for _, offset := range hits {
+		str, err := ir.f.ReadAt(offset, buf)
+		if err != nil {
+			return nil, err
+		}
+		if string(str) == string(q) {
+			hits[n] = offset
+			n++
+		}
+	}
+	return hits[0:n], nil
+}
 
-			fmt.Fprintf(os.Stdout, "%s: %s\033[32m%s\033[0m%s\n",
-				filename, lineLeft, q, lineRight)
+// queryGrams lists the byte spans of every n-gram inside q's CJK runs.
+func queryGrams(q []byte, gram int) (spans [][2]int) {
+	var starts []int
+	flush := func(end int) {
+		for i := 0; i + gram <= len(starts); i++ {
+			stop := end
+			if i + gram < len(starts) {
+				stop = starts[i + gram]
+			}
+			spans = append(spans, [2]int{ starts[i], stop })
+		}
+		starts = starts[0:0]
+	}
+	for i := 0; i < len(q); {
+		r, n := utf8.DecodeRune(q[i:])
+		if isCJK(r) {
+			starts = append(starts, i)
+		} else {
+			flush(i)
+		}
+		i += n
+	}
+	flush(len(q))
+	return
+}
+func longestCJKRun(q []byte) (longest int) {
+	run := 0
+	for _, r := range string(q) {
+		if isCJK(r) {
+			run++
+			if run > longest { longest = run }
 		} else {
-			break
+			run = 0
+		}
+	}
+	return
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func intersectSorted(a, b []int64) []int64 {
+	n, i, j := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			if n == 0 || a[n-1] != a[i] {
+				a[n] = a[i]
+				n++
+			}
+			i++
+			j++
 		}
 	}
+	return a[0:n]
 }
 
 func bsearch(n int64, f func(int64) (bool, error)) (int64, error) {
@@ -92,5 +196,3 @@ func bsearch(n int64, f func(int64) (bool, error)) (int64, error) {
 	// i == j, f(i-1) == false, and f(j) (= f(i)) == true  =>  answer is i.
 	return i, nil
 }
-
-
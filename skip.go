@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// The "SKIP" section samples the index so a search can narrow its binary
+// search in memory before reading any entry. It holds the sample interval
+// and count (32 bits each), then per sample the entry index (64 bits), a
+// byte with the prefix length and 0x80 when the prefix is the whole text up
+// to the line end, and skipPrefix bytes of the entry text.
+const skipPrefix = 16
+
+var errBadSkip = errors.New("bad skip table")
+
+// skipInterval samples every 64th term, or fewer to keep about a million
+// samples.
+func skipInterval(n int) int {
+	k := 64
+	if n / k > 1 << 20 {
+		k = n >> 20
+	}
+	return k
+}
+
+type skipSample struct {
+	index  int64
+	prefix []byte
+	whole  bool
+}
+
+// DumpSkip encodes the samples taken every k terms or entries.
+func DumpSkip(samples []skipSample, k int) []byte {
+	buf := new(bytes.Buffer)
+	head := make([]byte, 9 + skipPrefix)
+	binary.BigEndian.PutUint32(head[0:], uint32(k))
+	binary.BigEndian.PutUint32(head[4:], uint32(len(samples)))
+	buf.Write(head[0:8])
+	for _, sp := range samples {
+		for i := range head {
+			head[i] = 0
+		}
+		binary.BigEndian.PutUint64(head[0:], uint64(sp.index))
+		n := copy(head[9:], sp.prefix)
+		head[8] = byte(n)
+		if sp.whole {
+			head[8] |= 0x80
+		}
+		buf.Write(head)
+	}
+	return buf.Bytes()
+}
+
+// termSamples samples every kth term of a sorted index by its leading bytes.
+func termSamples(index *Index, dict []dictEntry, k int) []skipSample {
+	var samples []skipSample
+	for i := 0; i < len(dict); i += k {
+		term := index.Get(dict[i].start)
+		samples = append(samples, skipSample{
+			index:  int64(dict[i].start),
+			prefix: append([]byte(nil), term[0:min(len(term), skipPrefix)]...),
+			whole:  len(term) <= skipPrefix,
+		})
+	}
+	return samples
+}
+
+// entrySamples samples every kth entry by its text up to the line end.
+func entrySamples(f *FileGroup, list positionList, k int) ([]skipSample, error) {
+	var samples []skipSample
+	buf := make([]byte, skipPrefix)
+	for i := 0; i < list.Len(); i += k {
+		str, err := f.ReadAt(list.GetPos(i), buf)
+		if err != nil {
+			return nil, err
+		}
+		end := lineEnd(str, 0)
+		samples = append(samples, skipSample{
+			index:  int64(i),
+			prefix: append([]byte(nil), str[0:end]...),
+			whole:  end < skipPrefix,
+		})
+	}
+	return samples, nil
+}
+
+// Skip loads the skip table, nil when the index has none or orders terms
+// numerically, where byte prefixes do not decide the order.
+func (ir *IndexReader) Skip() ([]skipSample, error) {
+	if ir.skip != nil || ir.meta["order"] == "numeric" {
+		return ir.skip, nil
+	}
+	sec, ok := ir.sections["SKIP"]
+	if !ok {
+		return nil, nil
+	}
+	data := make([]byte, sec.length)
+	if _, err := ir.fidx.ReadAt(data, sec.offset); err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, errBadSkip
+	}
+	every := int64(binary.BigEndian.Uint32(data[0:]))
+	n := int(binary.BigEndian.Uint32(data[4:]))
+	data = data[8:]
+	if len(data) != n * (9 + skipPrefix) {
+		return nil, errBadSkip
+	}
+	skip := make([]skipSample, n)
+	for j := range skip {
+		rec := data[j * (9 + skipPrefix):]
+		length := int(rec[8] & 0x7F)
+		if length > skipPrefix {
+			return nil, errBadSkip
+		}
+		skip[j] = skipSample{
+			index:  int64(binary.BigEndian.Uint64(rec)),
+			prefix: rec[9 : 9 + length],
+			whole:  rec[8] & 0x80 != 0,
+		}
+	}
+	ir.skip, ir.skipEvery = skip, every
+	return skip, nil
+}
+
+// compare is compareAt for the entries of a sample, ok false when the
+// prefix does not decide it.
+func (sp *skipSample) compare(q []byte) (c int, ok bool) {
+	n := min(len(sp.prefix), len(q))
+	if c = bytes.Compare(sp.prefix[0:n], q[0:n]); c != 0 {
+		return c, true
+	}
+	if len(q) <= len(sp.prefix) {
+		return 0, true
+	}
+	if sp.whole {
+		return -1, true
+	}
+	return 0, false
+}
+
+// narrow returns the range [lo, hi] holding the first of [start, end)
+// whose comparison with q satisfies pred, by the samples alone. Samples
+// that decide it fail pred up to those that share their prefix with q, and
+// satisfy it after. With terms set the range counts dictionary terms, every
+// skipEvery of which is sampled, rather than entries.
+func (ir *IndexReader) narrow(start, end int64, q []byte, pred func(c int) bool, terms bool) (lo, hi int64, err error) {
+	lo, hi = start, end
+	skip, err := ir.Skip()
+	if err != nil || skip == nil {
+		return
+	}
+	at := func(j int) int64 {
+		if terms {
+			return int64(j) * ir.skipEvery
+		}
+		return skip[j].index
+	}
+	a := sort.Search(len(skip), func(j int) bool {
+		c, ok := skip[j].compare(q)
+		return !ok || pred(c)
+	})
+	b := sort.Search(len(skip), func(j int) bool {
+		c, ok := skip[j].compare(q)
+		return ok && pred(c)
+	})
+	if a > 0 && at(a-1) + 1 > lo {
+		lo = at(a-1) + 1
+	}
+	if b < len(skip) && at(b) < hi {
+		hi = at(b)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// sortOrder "position" makes searches print hits in file and byte order
+// rather than in term order.
+var sortOrder string
+
+// sortRunSize hits are sorted in memory, more are spilled to temporary
+// files in sorted runs and merged.
+const sortRunSize = 1 << 20
+
+// posHit is a hit held back for sorting, tag < 0 for hits without an entry.
+type posHit struct {
+	offset int64
+	length int
+	tag    int
+}
+
+type posHits []posHit
+
+func (h posHits) Len() int           { return len(h) }
+func (h posHits) Less(i, j int) bool { return h[i].offset < h[j].offset }
+func (h posHits) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+type hitSorter struct {
+	hits posHits
+	runs []*os.File
+}
+
+func (hs *hitSorter) Add(h posHit) error {
+	hs.hits = append(hs.hits, h)
+	if len(hs.hits) < sortRunSize {
+		return nil
+	}
+	return hs.spill()
+}
+
+// spill writes the hits in memory out as a sorted run.
+func (hs *hitSorter) spill() error {
+	sort.Sort(hs.hits)
+	f, err := os.CreateTemp("", "textsearch-sort-")
+	if err != nil {
+		return err
+	}
+	hs.runs = append(hs.runs, f)
+	w := bufio.NewWriter(f)
+	rec := make([]byte, 16)
+	for _, h := range hs.hits {
+		binary.BigEndian.PutUint64(rec, uint64(h.offset))
+		binary.BigEndian.PutUint32(rec[8:], uint32(h.length))
+		binary.BigEndian.PutUint32(rec[12:], uint32(int32(h.tag)))
+		if _, err = w.Write(rec); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	_, err = f.Seek(0, 0)
+	hs.hits = hs.hits[0:0]
+	return err
+}
+
+// Each calls fn with every hit in offset order.
+func (hs *hitSorter) Each(fn func(h posHit) error) error {
+	if len(hs.runs) == 0 {
+		sort.Sort(hs.hits)
+		for _, h := range hs.hits {
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(hs.hits) > 0 {
+		if err := hs.spill(); err != nil {
+			return err
+		}
+	}
+	m := make(runMerge, 0, len(hs.runs))
+	for _, f := range hs.runs {
+		r := &runReader{ r: bufio.NewReader(f) }
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			m = append(m, r)
+		}
+	}
+	heap.Init(&m)
+	for len(m) > 0 {
+		r := m[0]
+		if err := fn(r.head); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&m, 0)
+		} else {
+			heap.Pop(&m)
+		}
+	}
+	return nil
+}
+
+// Close removes the spilled runs.
+func (hs *hitSorter) Close() {
+	for _, f := range hs.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	hs.runs = nil
+}
+
+type runReader struct {
+	r    *bufio.Reader
+	rec  [16]byte
+	head posHit
+}
+
+func (rr *runReader) next() (bool, error) {
+	_, err := io.ReadFull(rr.r, rr.rec[:])
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rr.head = posHit{
+		offset: int64(binary.BigEndian.Uint64(rr.rec[0:])),
+		length: int(binary.BigEndian.Uint32(rr.rec[8:])),
+		tag:    int(int32(binary.BigEndian.Uint32(rr.rec[12:]))),
+	}
+	return true, nil
+}
+
+type runMerge []*runReader
+
+func (m runMerge) Len() int            { return len(m) }
+func (m runMerge) Less(i, j int) bool  { return m[i].head.offset < m[j].head.offset }
+func (m runMerge) Swap(i, j int)       { m[i], m[j] = m[j], m[i] }
+func (m *runMerge) Push(x interface{}) { *m = append(*m, x.(*runReader)) }
+func (m *runMerge) Pop() interface{} {
+	old := *m
+	r := old[len(old)-1]
+	*m = old[0 : len(old)-1]
+	return r
+}
+
+// PrintSorted prints the hits held back by --sort=position.
+func (ir *IndexReader) PrintSorted() {
+	hs := ir.sorter
+	if hs == nil {
+		return
+	}
+	ir.sorter = nil
+	defer hs.Close()
+	if ir.ctx.Err() != nil {
+		return
+	}
+	handleErr(hs.Each(func(h posHit) error {
+		if h.tag < 0 {
+			return ir.PrintHit(h.offset, h.length, "")
+		}
+		return ir.printTagged(h.offset, h.length, h.tag)
+	}))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+var presetSplitters = map[string]SplitFunc{
+	"word":   splitWords,
+	"ident":  splitIdents,
+	"ipv4":   splitIPv4,
+	"ipv6":   splitIPv6,
+	"email":  splitEmails,
+	"uuid":   splitUUIDs,
+	"hash":   splitHashes,
+	"url":    splitURLs,
+	"number": splitNumbers,
+	"cjk":    splitCJK(2),
+	"cjk3":   splitCJK(3),
+}
+
+// presetGrams holds the n-gram size of the CJK presets, searches need it to
+// split long queries.
+var presetGrams = map[string]int{
+	"cjk":  2,
+	"cjk3": 3,
+}
+
+var errUnknownPreset = errors.New("unknown split preset")
+
+func NewPresetSpliter(name string) (*WordSpliter, error) {
+	fn, ok := presetSplitters[name]
+	if !ok {
+		return nil, errUnknownPreset
+	}
+	ws := new(WordSpliter)
+	ws.splitFn = fn
+	ws.Meta = indexMeta{ "split": name }
+	if gram := presetGrams[name]; gram > 0 {
+		ws.Meta["gram"] = strconv.Itoa(gram)
+	}
+	return ws, nil
+}
+func PresetNames() []string {
+	names := make([]string, 0, len(presetSplitters))
+	for name := range presetSplitters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isDigit(c byte) bool    { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool    { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isAlnum(c byte) bool    { return isAlpha(c) || isDigit(c) }
+func isIdentByte(c byte) bool { return isAlnum(c) || c == '_' }
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// wordRune reports whether the rune at b[i] is a letter or digit and its width.
+func wordRune(b []byte, i int) (bool, int) {
+	c := b[i]
+	if c < utf8.RuneSelf {
+		return isAlnum(c), 1
+	}
+	r, n := utf8.DecodeRune(b[i:])
+	return unicode.IsLetter(r) || unicode.IsDigit(r), n
+}
+
+func splitWords(b []byte) (m []int) {
+	start := -1
+	for i := 0; i < len(b); {
+		ok, n := wordRune(b, i)
+		if ok && start < 0 {
+			start = i
+		} else if !ok && start >= 0 {
+			m = append(m, start, i)
+			start = -1
+		}
+		i += n
+	}
+	if start >= 0 {
+		m = append(m, start, len(b))
+	}
+	return
+}
+
+func splitIdents(b []byte) (m []int) {
+	start := -1
+	for i := 0; i < len(b); {
+		ok, n := wordRune(b, i)
+		ok = ok || b[i] == '_'
+		if ok && start < 0 {
+			start = i
+		} else if !ok && start >= 0 {
+			if !isDigit(b[start]) {
+				m = append(m, start, i)
+			}
+			start = -1
+		}
+		i += n
+	}
+	if start >= 0 && !isDigit(b[start]) {
+		m = append(m, start, len(b))
+	}
+	return
+}
+
+// scanOctet reads a decimal number in 0-255 of at most three digits.
+func scanOctet(b []byte, i int) int {
+	v, j := 0, i
+	for j < len(b) && j-i < 3 && isDigit(b[j]) {
+		v = v*10 + int(b[j]-'0')
+		j++
+	}
+	if j == i || v > 255 || j < len(b) && isDigit(b[j]) {
+		return -1
+	}
+	return j
+}
+func splitIPv4(b []byte) (m []int) {
+	for i := 0; i < len(b); i++ {
+		if !isDigit(b[i]) || i > 0 && (isIdentByte(b[i-1]) || b[i-1] == '.') {
+			continue
+		}
+		j := i
+		for k := 0; k < 4 && j >= 0; k++ {
+			if k > 0 {
+				if j >= len(b) || b[j] != '.' {
+					j = -1
+					break
+				}
+				j++
+			}
+			j = scanOctet(b, j)
+		}
+		if j < 0 || j < len(b) && (isIdentByte(b[j]) || b[j] == '.' && j+1 < len(b) && isDigit(b[j+1])) {
+			for i < len(b) && (isDigit(b[i]) || b[i] == '.') {
+				i++
+			}
+			continue
+		}
+		m = append(m, i, j)
+		i = j
+	}
+	return
+}
+
+func splitIPv6(b []byte) (m []int) {
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if !isHex(c) && c != ':' || i > 0 && (isIdentByte(b[i-1]) || b[i-1] == ':') {
+			continue
+		}
+		j, colons := i, 0
+		for j < len(b) && (isHex(b[j]) || b[j] == ':' || b[j] == '.') {
+			if b[j] == ':' {
+				colons++
+			}
+			j++
+		}
+		for j > i && b[j-1] == '.' {
+			j--
+		}
+		if colons >= 2 && (j >= len(b) || !isIdentByte(b[j])) {
+			if net.ParseIP(string(b[i:j])) != nil {
+				m = append(m, i, j)
+			}
+		}
+		i = j
+	}
+	return
+}
+
+func isEmailLocal(c byte) bool {
+	return isIdentByte(c) || c == '.' || c == '%' || c == '+' || c == '-'
+}
+func isDomainByte(c byte) bool { return isAlnum(c) || c == '.' || c == '-' }
+func splitEmails(b []byte) (m []int) {
+	last := 0
+	for i := 1; i < len(b)-1; i++ {
+		if b[i] != '@' {
+			continue
+		}
+		start := i
+		for start > last && isEmailLocal(b[start-1]) {
+			start--
+		}
+		end := i+1
+		for end < len(b) && isDomainByte(b[end]) {
+			end++
+		}
+		for end > i+1 && (b[end-1] == '.' || b[end-1] == '-') {
+			end--
+		}
+		// the domain needs a dot of its own, not one trimmed off its end
+		if start < i && end > i+1 && bytes.IndexByte(b[i+1:end], '.') >= 0 && isAlnum(b[i+1]) {
+			m = append(m, start, end)
+			last = end
+			i = end - 1
+		}
+	}
+	return
+}
+
+func isUUID(b []byte) bool {
+	for k, c := range b[0:36] {
+		if k == 8 || k == 13 || k == 18 || k == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !isHex(c) {
+			return false
+		}
+	}
+	return true
+}
+func splitUUIDs(b []byte) (m []int) {
+	for i := 0; i+36 <= len(b); i++ {
+		if i > 0 && isIdentByte(b[i-1]) || !isHex(b[i]) {
+			continue
+		}
+		j := i + 36
+		if isUUID(b[i:]) && (j == len(b) || !isIdentByte(b[j])) {
+			m = append(m, i, j)
+			i = j
+		}
+	}
+	return
+}
+
+// hashMinLen is the shortest hex run treated as a hash (64-bit digest).
+const hashMinLen = 16
+
+func splitHashes(b []byte) (m []int) {
+	for i := 0; i < len(b); {
+		if !isIdentByte(b[i]) {
+			i++
+			continue
+		}
+		start, hex := i, true
+		for i < len(b) && isIdentByte(b[i]) {
+			if !isHex(b[i]) {
+				hex = false
+			}
+			i++
+		}
+		if hex && i-start >= hashMinLen {
+			m = append(m, start, i)
+		}
+	}
+	return
+}
+
+func isURLByte(c byte) bool {
+	return c > ' ' && c < 0x7f && c != '"' && c != '\'' && c != '<' && c != '>' && c != '`'
+}
+func splitURLs(b []byte) (m []int) {
+	for i := 1; i+3 < len(b); i++ {
+		if b[i] != ':' || b[i+1] != '/' || b[i+2] != '/' {
+			continue
+		}
+		start := i
+		for start > 0 && (isAlnum(b[start-1]) || b[start-1] == '+' || b[start-1] == '.' || b[start-1] == '-') {
+			start--
+		}
+		for start < i && !isAlpha(b[start]) {
+			start++
+		}
+		end := i + 3
+		for end < len(b) && isURLByte(b[end]) {
+			end++
+		}
+		for end > i+3 {
+			c := b[end-1]
+			if c != '.' && c != ',' && c != ';' && c != ':' && c != ')' && c != ']' && c != '}' {
+				break
+			}
+			end--
+		}
+		if start == i || end == i+3 {
+			continue
+		}
+		m = append(m, start, end)
+		i = end - 1
+	}
+	return
+}
+
+func splitNumbers(b []byte) (m []int) {
+	for i := 0; i < len(b); {
+		c := b[i]
+		if !isDigit(c) && !(c == '-' && i+1 < len(b) && isDigit(b[i+1])) ||
+			i > 0 && (isIdentByte(b[i-1]) || b[i-1] == '.') {
+			i++
+			continue
+		}
+		start := i
+		i++
+		for i < len(b) && isDigit(b[i]) {
+			i++
+		}
+		if i+1 < len(b) && b[i] == '.' && isDigit(b[i+1]) {
+			i++
+			for i < len(b) && isDigit(b[i]) {
+				i++
+			}
+		}
+		if i < len(b) && (isIdentByte(b[i]) || b[i] == '.' && i+1 < len(b) && isDigit(b[i+1])) {
+			for i < len(b) && (isIdentByte(b[i]) || b[i] == '.') {
+				i++
+			}
+			continue
+		}
+		m = append(m, start, i)
+	}
+	return
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// splitCJK emits word tokens, except that inside CJK runs every rune starts
+// an overlapping n-gram; the last ones of a run are shorter.
+func splitCJK(gram int) SplitFunc {
+	return func(b []byte) (m []int) {
+		var starts []int
+		flush := func(end int) {
+			for i, start := range starts {
+				stop := end
+				if i+gram < len(starts) {
+					stop = starts[i+gram]
+				}
+				m = append(m, start, stop)
+			}
+			starts = starts[0:0]
+		}
+		wordStart := -1
+		for i := 0; i < len(b); {
+			var cjk, word bool
+			n := 1
+			if b[i] < utf8.RuneSelf {
+				word = isAlnum(b[i])
+			} else {
+				var r rune
+				r, n = utf8.DecodeRune(b[i:])
+				cjk = isCJK(r)
+				word = !cjk && (unicode.IsLetter(r) || unicode.IsDigit(r))
+			}
+			if !word && wordStart >= 0 {
+				m = append(m, wordStart, i)
+				wordStart = -1
+			}
+			if cjk {
+				starts = append(starts, i)
+			} else {
+				flush(i)
+				if word && wordStart < 0 {
+					wordStart = i
+				}
+			}
+			i += n
+		}
+		if wordStart >= 0 {
+			m = append(m, wordStart, len(b))
+		}
+		flush(len(b))
+		return
+	}
+}
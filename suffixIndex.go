@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// suffixArray holds the sorted suffix positions kept for the index.
+type suffixArray []int32
+
+func (sa suffixArray) Len() int             { return len(sa) }
+func (sa suffixArray) GetPos(i int) int64   { return int64(sa[i]) }
+
+var errSuffixTooLarge = errors.New("source too large for suffix mode")
+
+func makeSuffixIndex(ctx context.Context, base string, outfile string, runeStarts, blocks bool, inline int) {
+	printf("Index Output: %s\n", outfile)
+	indexFile, err := createIndex(outfile)
+	if handleErr(err) { return }
+	defer indexFile.Abort()
+
+	printf("Source: %s\n", base)
+	f, err := NewFileGroupDirectory(base)
+	if handleErr(err) { return }
+	defer f.Close()
+	f.SetHandleLimit(maxOpen)
+	f.SetMapLimit(mapLimit(true))
+	if f.Size() + int64(f.FileCount()) >= 1 << 31 - 1 {
+		handleErr(errSuffixTooLarge)
+		return
+	}
+
+	sb := &suffixBuilder{ ByteTotal: f.Size() }
+	StatFunc("Read", sb, func() {
+		err = sb.ReadText(ctx, f)
+		handleErr(err)
+	})
+	if err != nil { return }
+
+	StatFunc("Sorting", sb, func() {
+		err = sb.Build(ctx, runeStarts)
+	})
+	if handleErr(err) { return }
+
+	posBits := uint(1)
+	for ; 1 << posBits < f.Size(); posBits++ { }
+
+	meta := indexMeta{ "mode": "suffix" }
+	if runeStarts {
+		meta["runes"] = "1"
+	}
+	if blocks {
+		meta["positions"] = "blocks"
+	}
+	if inline > 0 {
+		meta["inline"] = strconv.Itoa(inline)
+	}
+	printf("Write Index ...")
+	if handleErr(writeIndexHead(indexFile, f, meta)) { return }
+	streamStart, err := indexFile.Seek(0, 1)
+	if handleErr(err) { return }
+
+	indexW := new(indexWriter)
+	StatFunc("WriteOut", indexW, func() {
+		if blocks {
+			err = indexW.DoWriteBlocks(ctx, indexFile, sb.sa, posBits, 0)
+		} else {
+			err = indexW.DoWrite(ctx, indexFile, sb.sa, posBits, 0)
+		}
+	})
+	if handleErr(err) { return }
+	streamEnd, err := indexFile.Seek(0, 1)
+	if handleErr(err) { return }
+
+	k := skipInterval(sb.sa.Len())
+	samples, err := entrySamples(f, sb.sa, k)
+	if handleErr(err) { return }
+	if handleErr(writeSection(indexFile, "SKIP", DumpSkip(samples, k))) { return }
+	if inline > 0 {
+		printf("Write Prefixes ...\n")
+		buf := make([]byte, inline)
+		pref, err := DumpPrefixes(sb.sa.Len(), inline, func(i int) ([]byte, bool, error) {
+			return entryPrefix(f, sb.sa.GetPos(i), buf)
+		})
+		if handleErr(err) { return }
+		if handleErr(writeSection(indexFile, "PREF", pref)) { return }
+	}
+
+	printf("Write Checksums ...\n")
+	if handleErr(writeSums(indexFile.File, streamStart, streamEnd)) { return }
+	if handleErr(ctx.Err()) { return }
+	handleErr(indexFile.Commit())
+}
+
+// suffixBuilder keeps its progress in counters updated atomically, StatFunc
+// prints them from its own goroutine.
+type suffixBuilder struct {
+	ByteTotal     int64
+	byteCount     int64
+	lastByteCount int64
+	suffixCount   int64
+
+	text []int32
+	ends []int32
+	sa   suffixArray
+}
+
+// ReadText loads the whole group as SA-IS symbols. Line terminators become
+// 0, below every other byte, so suffixes order the same as lines cut at their
+// end, which is how searchIndex compares them. Every file end adds a 0 too,
+// kept in ends, as a search stops there whether or not a newline did.
+func (sb *suffixBuilder) ReadText(ctx context.Context, f *FileGroup) error {
+	sb.text = make([]int32, 0, f.Size() + int64(f.FileCount()))
+	r := ctxReader{ ctx, f }
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadSlice('\n')
+		atomic.AddInt64(&sb.byteCount, int64(len(line)))
+		end := len(line)
+		if end > 0 && line[end-1] == '\n' {
+			end--
+			if end > 0 && line[end-1] == '\r' {
+				end--
+			}
+		}
+		for _, c := range line[0:end] {
+			sb.text = append(sb.text, int32(c) + 1)
+		}
+		for i := end; i < len(line); i++ {
+			sb.text = append(sb.text, 0)
+		}
+
+		if err == io.EOF {
+			sb.ends = append(sb.ends, int32(len(sb.text)))
+			sb.text = append(sb.text, 0)
+			if !f.GroupEOF() {
+				br.Reset(r)
+				continue
+			}
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// Build sorts every suffix and keeps those starting inside a line, or only
+// those starting a UTF-8 rune when runeStarts is set, as source offsets: a
+// text position less the file ends before it. It stops with ctx's error once
+// ctx is done.
+func (sb *suffixBuilder) Build(ctx context.Context, runeStarts bool) error {
+	sa := make([]int32, len(sb.text))
+	if err := sais(ctx, sb.text, sa, 257); err != nil {
+		return err
+	}
+	n := 0
+	for _, p := range sa {
+		c := sb.text[p]
+		if c == 0 || runeStarts && (c - 1) & 0xC0 == 0x80 {
+			continue
+		}
+		sa[n] = p - int32(sort.Search(len(sb.ends), func(k int) bool { return sb.ends[k] > p }))
+		n++
+	}
+	sb.sa = suffixArray(sa[0:n])
+	sb.text, sb.ends = nil, nil
+	atomic.StoreInt64(&sb.suffixCount, int64(n))
+	return nil
+}
+func (sb *suffixBuilder) ResetStat() {
+	sb.lastByteCount = 0
+}
+func (sb *suffixBuilder) PrintStat(d time.Duration, last bool) {
+	byteCount := atomic.LoadInt64(&sb.byteCount)
+	var readTotal, readSpeed float64
+	var readTotalUnit, readSpeedUnit string
+	readTotal, readTotalUnit = FormatUnit(float64(byteCount))
+	if last {
+		readSpeed, readSpeedUnit = FormatUnit(float64(byteCount) / d.Seconds())
+	} else {
+		readSpeed, readSpeedUnit = FormatUnit(float64(byteCount - sb.lastByteCount) / d.Seconds())
+	}
+	sb.lastByteCount = byteCount
+	printf("Suffix: %12d  Read: %6.1f%sB(%6.1f%sB/s)",
+		atomic.LoadInt64(&sb.suffixCount), readTotal, readTotalUnit, readSpeed, readSpeedUnit)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+// A file without a final newline must not run on into the next one: the
+// "ab" ending the first file would sort as "abd", after "abc", whichever
+// file comes first.
+func TestSuffixIndexFileEnds(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{ "a.txt", "b.txt" } {
+		if err := os.WriteFile(path.Join(dir, name), []byte("d\nabc\nab"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	index := path.Join(dir, ".index")
+	makeSuffixIndex(ctx, dir, index, false, false, 0)
+	if _, err := os.Stat(index); err != nil {
+		t.Fatal(err)
+	}
+	if n := verifyIndex(ctx, dir, index); n != 0 {
+		t.Fatalf("verify found %d problems", n)
+	}
+
+	ir, err := OpenIndex(ctx, dir, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	for q, want := range map[string]int{ "ab": 4, "abc": 2, "abd": 0, "bd": 0, "b": 4 } {
+		hits, err := ir.Lookup([]byte(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != want {
+			t.Errorf("%q: %d hits, want %d", q, len(hits), want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type Suggestion struct {
+	Term  []byte
+	Count int64
+}
+
+// Suggest returns up to k distinct terms beginning with prefix, the most
+// frequent first. Rather than walking the whole prefix range it looks at 4k
+// spaced entries and finds the term run each falls in, so any term holding
+// more than a 4k-th of the range is found after O(k log n) reads.
+// Without a dictionary the run of a term is all entries beginning with it.
+func (ir *IndexReader) Suggest(prefix []byte, k int) ([]Suggestion, error) {
+	s, e := int64(0), ir.Len()
+	if len(prefix) > 0 {
+		var err error
+		s, e, err = ir.Range(prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if k <= 0 || s >= e {
+		return nil, nil
+	}
+	var list []Suggestion
+	td, err := ir.Dict()
+	if err != nil && err != errNoDict {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	// every run found takes one of the samples, the rest are spread again
+	// over what follows it
+	for p, left := s, int64(4 * k); p < e && left > 0; left-- {
+		next := p + (e - p) / left
+		if next == p {
+			next++
+		}
+		if td == nil {
+			offset, err := ir.Pos(p)
+			if err != nil {
+				return nil, err
+			}
+			str, err := ir.f.ReadAt(offset, ir.buf)
+			if err != nil {
+				return nil, err
+			}
+			term := str[0:entrySpan(str[0:lineEnd(str, 0)])]
+			if seen[string(term)] {
+				p = next
+				continue
+			}
+			seen[string(term)] = true
+			term = append([]byte(nil), term...)
+			start, end, err := ir.Range(term)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, Suggestion{ term, end - start })
+			p = next
+			continue
+		}
+		i, err := bsearch(td.Len(), func(i int64) (bool, error) {
+			start, _, err := td.Entry(i)
+			return start > p, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		term, start, end, err := ir.Term(i - 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Suggestion{ term, end - start })
+		p = next
+		if end > next {
+			p = end
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return bytes.Compare(list[i].Term, list[j].Term) < 0
+	})
+	if len(list) > k {
+		list = list[0:k]
+	}
+	return list, nil
+}
+
+func searchSuggest(ctx context.Context, base, index string, prefix []byte, k int) {
+	ir, err := OpenIndex(ctx, base, index)
+	if handleErr(err) { return }
+	defer ir.Close()
+	list, err := ir.Suggest(prefix, k)
+	if handleErr(err) { return }
+	for _, sg := range list {
+		fmt.Fprintf(os.Stdout, "%s\t%d\n", sg.Term, sg.Count)
+	}
+}
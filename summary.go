@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// summaryMode, when set, makes searches collect hits per file instead of
+// printing them: "files" lists the files with hits, "count" adds the number
+// of hits, "histogram" draws both per file and per hour of the timestamps
+// the hit lines start with.
+var summaryMode string
+
+type hitSummary struct {
+	files []int64
+	hours map[string]int64
+}
+
+// summarize counts the hit at offset.
+func (ir *IndexReader) summarize(offset int64) error {
+	if err := ir.ctx.Err(); err != nil {
+		return err
+	}
+	if ir.summary.files == nil {
+		ir.summary.files = make([]int64, ir.f.FileCount())
+		ir.summary.hours = make(map[string]int64)
+	}
+	ir.summary.files[ir.f.OffsetIndex(offset)]++
+	if summaryMode != "histogram" {
+		return nil
+	}
+	start, err := ir.LineStart(offset)
+	if err != nil {
+		return err
+	}
+	line, err := ir.ReadLine(start)
+	if err != nil {
+		return err
+	}
+	if hour := lineHour(line); hour != "" {
+		ir.summary.hours[hour]++
+	}
+	return nil
+}
+
+// PrintSummary prints what summarize collected, if summaryMode is set.
+func (ir *IndexReader) PrintSummary() {
+	if ir.summary == nil || ir.ctx.Err() != nil {
+		return
+	}
+	var most int64
+	for _, n := range ir.summary.files {
+		if n > most { most = n }
+	}
+	for i, n := range ir.summary.files {
+		if n == 0 {
+			continue
+		}
+		filename, _ := ir.f.Filename(ir.f.FileOffset(i))
+		switch summaryMode {
+		case "files":
+			fmt.Fprintf(os.Stdout, "%s\n", filename)
+		case "count":
+			fmt.Fprintf(os.Stdout, "%s: %d\n", filename, n)
+		default:
+			fmt.Fprintf(os.Stdout, "%-24s %8d %s\n", filename, n, histogramBar(n, most))
+		}
+	}
+	if summaryMode != "histogram" || len(ir.summary.hours) == 0 {
+		return
+	}
+	hours := make([]string, 0, len(ir.summary.hours))
+	most = 0
+	for h, n := range ir.summary.hours {
+		hours = append(hours, h)
+		if n > most { most = n }
+	}
+	sort.Strings(hours)
+	fmt.Fprintf(os.Stdout, "\n")
+	for _, h := range hours {
+		n := ir.summary.hours[h]
+		fmt.Fprintf(os.Stdout, "%-24s %8d %s\n", h, n, histogramBar(n, most))
+	}
+}
+
+func histogramBar(n, most int64) string {
+	return strings.Repeat("#", int((n * 50 + most - 1) / most))
+}
+
+var (
+	isoTime    = regexp.MustCompile(`(\d{4}-\d{2}-\d{2})[T ](\d{2}):\d{2}`)
+	commonTime = regexp.MustCompile(`(\d{2})/([A-Z][a-z]{2})/(\d{4}):(\d{2}):\d{2}`)
+	syslogTime = regexp.MustCompile(`^([A-Z][a-z]{2}) +(\d{1,2}) (\d{2}):\d{2}:\d{2}`)
+)
+
+// lineHour returns the hour a line is stamped with near its start as
+// "2006-01-02 15:00", without the year for syslog stamps, or "".
+func lineHour(line []byte) string {
+	if len(line) > 64 {
+		line = line[0:64]
+	}
+	if m := isoTime.FindSubmatch(line); m != nil {
+		return fmt.Sprintf("%s %s:00", m[1], m[2])
+	}
+	if m := commonTime.FindSubmatch(line); m != nil {
+		if month := monthNumber(m[2]); month > 0 {
+			return fmt.Sprintf("%s-%02d-%s %s:00", m[3], month, m[1], m[4])
+		}
+	}
+	if m := syslogTime.FindSubmatch(line); m != nil {
+		if month := monthNumber(m[1]); month > 0 {
+			day, _ := strconv.Atoi(string(m[2]))
+			return fmt.Sprintf("%02d-%02d %s:00", month, day, m[3])
+		}
+	}
+	return ""
+}
+
+func monthNumber(name []byte) int {
+	i := strings.Index("JanFebMarAprMayJunJulAugSepOctNovDec", string(name))
+	if i < 0 || i % 3 != 0 {
+		return 0
+	}
+	return i / 3 + 1
+}
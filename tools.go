@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"time"
 	"fmt"
@@ -66,6 +68,12 @@ func min(a, b int) int {
 	}
 	return b
 }
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
 
 func lineStart(b []byte, start int) (i int) {
 	if start >= len(b) {
@@ -91,10 +99,19 @@ func lineEnd(b []byte, start int) (i int) {
 	return
 }
 
+// exitStatus is 1 once an error was handled, 130 when the run was
+// interrupted.
+var exitStatus int
+
 func handleErr(err error) bool {
 	if err == nil {
 		return false
 	}
+	if errors.Is(err, context.Canceled) {
+		exitStatus = 130
+	} else if exitStatus == 0 {
+		exitStatus = 1
+	}
 	callDepth := 1
 	if _, ok := err.(errStr); ok {
 		callDepth = 2
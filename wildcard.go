@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// globQuery is a term pattern where * matches any run of characters and ?
+// a single one; a backslash makes the next byte literal. prefix and suffix
+// are the literal text before the first and after the last wildcard.
+type globQuery struct {
+	prefix []byte
+	suffix []byte
+	re     *regexp.Regexp
+}
+
+// compileGlob returns nil when q has no wildcard.
+func compileGlob(q []byte) *globQuery {
+	gq := new(globQuery)
+	expr := new(strings.Builder)
+	expr.WriteString(`^(?s:`)
+	var lit []byte
+	wild := false
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		if c == '\\' && i + 1 < len(q) {
+			i++
+			lit = append(lit, q[i])
+			continue
+		}
+		if c != '*' && c != '?' {
+			lit = append(lit, c)
+			continue
+		}
+		if !wild {
+			gq.prefix = lit
+		}
+		wild = true
+		expr.WriteString(regexp.QuoteMeta(string(lit)))
+		lit = nil
+		if c == '*' {
+			expr.WriteString(`.*`)
+		} else {
+			expr.WriteString(`.`)
+		}
+	}
+	if !wild {
+		return nil
+	}
+	gq.suffix = lit
+	expr.WriteString(regexp.QuoteMeta(string(lit)))
+	expr.WriteString(`)$`)
+	gq.re = regexp.MustCompile(expr.String())
+	return gq
+}
+
+// searchWildcard prints the entries of every term matching gq. Candidates
+// are the terms beginning with its prefix, or when there is none but a
+// reversed array is built, the terms ending with its suffix.
+func searchWildcard(ir *IndexReader, gq *globQuery) {
+	if len(gq.prefix) == 0 && len(gq.suffix) > 0 {
+		if _, err := ir.Reversed(); err == nil {
+			start, end, err := ir.SuffixRange(gq.suffix)
+			if handleErr(err) { return }
+			for i := start; i < end; i++ {
+				pos, length, tag, err := ir.rev.Entry(i, ir.tagBits)
+				if handleErr(err) { return }
+				term, err := ir.f.ReadAt(pos, ir.buf[0:min(length, len(ir.buf))])
+				if handleErr(err) { return }
+				if !gq.re.Match(term) {
+					continue
+				}
+				if handleErr(ir.printTagged(pos, length, tag)) { return }
+			}
+			return
+		}
+	}
+
+	s, e := int64(0), ir.Len()
+	if len(gq.prefix) > 0 {
+		var err error
+		s, e, err = ir.Range(gq.prefix)
+		if handleErr(err) { return }
+	}
+	handleErr(ir.eachTerm(s, e, func(term []byte, start, end int64) error {
+		if !gq.re.Match(term) {
+			return nil
+		}
+		for i := start; i < end; i++ {
+			if err := ir.PrintEntry(i, len(term)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"regexp"
 	"time"
 	"io"
-	"os"
 	"bufio"
 	"sync/atomic"
 )
@@ -14,6 +14,9 @@ type WordSpliter struct {
 	ByteTotal        int64
 	lastByteCount    int64
 
+	Meta             indexMeta
+	TagBits          uint
+
 	wordSpliteWorker
 }
 
@@ -23,6 +26,7 @@ func NewWordSpliter(re string) (*WordSpliter, error) {
 		return nil, err
 	}
 	ws := new(WordSpliter)
+	ws.Meta = indexMeta{}
 	ws.splitFn = func(b []byte) []int {
 		m := r.FindSubmatchIndex(b)
 		if len(m) > 2 {
@@ -36,168 +40,110 @@ func (ws *WordSpliter) ResetStat() {
 	ws.lastByteCount = 0
 }
 func (ws *WordSpliter) PrintStat(d time.Duration, last bool) {
+	stat := ws.snapshot()
 	var readTotal, readSpeed float64
 	var readTotalUnit, readSpeedUnit string
-	readTotal, readTotalUnit = FormatUnit(float64(ws.byteCount))
+	readTotal, readTotalUnit = FormatUnit(float64(stat.byteCount))
 	if last {
-		readSpeed, readSpeedUnit = FormatUnit(float64(ws.byteCount) / d.Seconds())
+		readSpeed, readSpeedUnit = FormatUnit(float64(stat.byteCount) / d.Seconds())
 	} else {
-		readSpeed, readSpeedUnit = FormatUnit(float64(ws.byteCount - ws.lastByteCount) / d.Seconds())
+		readSpeed, readSpeedUnit = FormatUnit(float64(stat.byteCount - ws.lastByteCount) / d.Seconds())
 	}
-	ws.lastByteCount = ws.byteCount
+	ws.lastByteCount = stat.byteCount
 	if ws.ByteTotal > 0 {
 		percentage := float64(100)
 		if !last {
-			percentage = (float64(ws.byteCount) / float64(ws.ByteTotal) * 100)
+			percentage = (float64(stat.byteCount) / float64(ws.ByteTotal) * 100)
 		}
 		printf("Entry: %12d  Read: %6.1f%sB(%6.1f%sB/s)  Word(Min/Max): %6d/%6d [%5.1f%%]",
-			ws.entryCount,
+			stat.entryCount,
 			readTotal, readTotalUnit, readSpeed, readSpeedUnit,
-			ws.wordMin, ws.wordMax,
+			stat.wordMin, stat.wordMax,
 			percentage)
 	} else {
 		printf("Entry: %12d  Read: %6.1f%sB(%6.1f%sB/s)  Word(Min/Max): %6d/%6d",
-			ws.entryCount,
+			stat.entryCount,
 			readTotal, readTotalUnit, readSpeed, readSpeedUnit,
-			ws.wordMin, ws.wordMax)
+			stat.wordMin, stat.wordMax)
 	}
 }
-func (ws *WordSpliter) MeasureMulit(f *FileGroup, co int) (err error) {
-	if co <= 1 {
-		return ws.Measure(f)
-	}
-
-	var taskSeed int32
-	finished := make(chan wordSpliterStats, co)
-	workers := make([]*wordSpliteWorker, co)
-	for i := 0; i < co; i++ {
-		workers[i] = &wordSpliteWorker{
-			splitFn: ws.splitFn,
-		}
-		go func(i int) {
-			for {
-				if err != nil {
-					return
-				}
-				task := int(atomic.AddInt32(&taskSeed, 1) - 1)
-				if task >= f.FileCount() {
-					return
-				}
-
-				worker := workers[i]
-				worker.offset = f.FileOffset(task)
-				var file *os.File
-				file, err = f.OpenFile(task)
-				if err != nil {
-					return
-				}
-				_, err = file.Seek(0, 0)
-				if err != nil {
-					return
-				}
-				err = worker.Measure(&io.LimitedReader{ file, f.FileSize(task) })
-				if err != nil {
-					return
-				}
-				finished <- worker.wordSpliterStats
-			}
-		}(i)
-	}
-
-	finishedStat := wordSpliterStats{}
-	t := time.NewTicker(50 * time.Millisecond)
-	defer t.Stop()
-	var finishedCount int
-	for {
-		if err != nil {
-			return
-		}
-		select {
-		case v := <- finished:
-			finishedStat = finishedStat.Merge(v)
-			finishedCount++
-			if finishedCount >= f.FileCount() {
-				ws.wordSpliteWorker.wordSpliterStats = finishedStat
-				return
-			}
-
-		case <- t.C:
-			stat := finishedStat
-			for _, worker := range workers {
-				stat = stat.Merge(worker.wordSpliterStats)
-			}
-			ws.wordSpliteWorker.wordSpliterStats = stat
-		}
-	}
-	return
+func (ws *WordSpliter) MeasureMulit(ctx context.Context, f *FileGroup, co int) error {
+	return ws.runWorkers(ctx, f, co, func(worker *wordSpliteWorker, r io.Reader) error {
+		return worker.Measure(r)
+	})
 }
-func (ws *WordSpliter) ReadIntoIndexMulit(f *FileGroup, index *Index, co int) (err error) {
-	if co <= 1 {
-		return ws.ReadIntoIndex(f, index)
+func (ws *WordSpliter) ReadIntoIndexMulit(ctx context.Context, f *FileGroup, index *Index, co int) error {
+	return ws.runWorkers(ctx, f, co, func(worker *wordSpliteWorker, r io.Reader) error {
+		return worker.ReadIntoIndex(r, index)
+	})
+}
+// runWorkers hands the files of f out to co workers, at least one, merging
+// their stats. The first error or the end of ctx stops them all. Workers
+// publish snapshots of their stats, the progress ticks only read those.
+func (ws *WordSpliter) runWorkers(ctx context.Context, f *FileGroup, co int, fn func(worker *wordSpliteWorker, r io.Reader) error) error {
+	if co < 1 {
+		co = 1
 	}
-
 	var taskSeed int32
+	ws.progress.Store(wordSpliterStats{})
+	g := newWorkGroup(ctx)
 	finished := make(chan wordSpliterStats, co)
 	workers := make([]*wordSpliteWorker, co)
 	for i := 0; i < co; i++ {
-		workers[i] = &wordSpliteWorker{
+		worker := &wordSpliteWorker{
 			splitFn: ws.splitFn,
+			csv:     ws.csv,
+			json:    ws.json,
 		}
-		go func(i int) {
-			for {
-				if err != nil {
-					return
-				}
+		workers[i] = worker
+		g.Go(func() error {
+			for !g.Stopped() {
 				task := int(atomic.AddInt32(&taskSeed, 1) - 1)
 				if task >= f.FileCount() {
-					return
+					return nil
 				}
-				worker := workers[i]
 				worker.offset = f.FileOffset(task)
-				var file *os.File
-				file, err = f.OpenFile(task)
+				file, err := f.OpenFile(task)
 				if err != nil {
-					return
+					return err
 				}
-				_, err = file.Seek(0, 0)
+				err = fn(worker, ctxReader{ ctx, io.NewSectionReader(file, 0, f.FileSize(task)) })
+				f.ReleaseFile(task)
 				if err != nil {
-					return
+					return err
 				}
-				err = worker.ReadIntoIndex(&io.LimitedReader{ file, f.FileSize(task) }, index)
-				if err != nil {
-					return
+				select {
+				case finished <- worker.wordSpliterStats:
+				case <-g.Done():
 				}
-				finished <- worker.wordSpliterStats
 			}
-		}(i)
+			return nil
+		})
 	}
 
 	finishedStat := wordSpliterStats{}
 	t := time.NewTicker(50 * time.Millisecond)
 	defer t.Stop()
-	var finishedCount int
-	for {
-		if err != nil {
-			return
-		}
+	for finishedCount := 0; finishedCount < f.FileCount(); {
 		select {
 		case v := <-finished:
 			finishedStat = finishedStat.Merge(v)
 			finishedCount++
-			if finishedCount >= f.FileCount() {
-				ws.wordSpliteWorker.wordSpliterStats = finishedStat
-				return
-			}
 
-		case <- t.C:
+		case <-g.Done():
+			return g.Wait()
+
+		case <-t.C:
 			stat := finishedStat
 			for _, worker := range workers {
-				stat = stat.Merge(worker.wordSpliterStats)
+				stat = stat.Merge(worker.snapshot())
 			}
-			ws.wordSpliteWorker.wordSpliterStats = stat
+			ws.progress.Store(stat)
 		}
 	}
-	return
+	ws.wordSpliterStats = finishedStat
+	ws.progress.Store(finishedStat)
+	return g.Wait()
 }
 func (ws *WordSpliter) WordStat() (min, max int) {
 	return ws.wordMin, ws.wordMax
@@ -211,28 +157,41 @@ func (ws *WordSpliter) EntryCount() int {
 
 type wordSpliteWorker struct {
 	splitFn          SplitFunc
+	csv              *csvFormat
+	json             *jsonFormat
 	offset           int64
 
 	wordSpliterStats
+	progress         atomic.Value
+}
+// snapshot returns the stats last published by the goroutine scanning.
+func (ws *wordSpliteWorker) snapshot() wordSpliterStats {
+	stat, _ := ws.progress.Load().(wordSpliterStats)
+	return stat
 }
 func (ws *wordSpliteWorker) scanlines(r io.Reader, fn func(line []byte, offset int64)) (err error) {
 	br := bufio.NewReader(r)
 	ws.wordSpliterStats = wordSpliterStats{}
+	ws.progress.Store(ws.wordSpliterStats)
 	offset := ws.offset
 	var line []byte
-	for {
+	for lines := 1; ; lines++ {
 		line, err = br.ReadBytes('\n')
 		ws.byteCount += int64(len(line))
-		if len(line) > 1 {
-			end := len(line) - 2
-			if line[end] == '\r' {
+		end := len(line)
+		if end > 0 && line[end-1] == '\n' {
+			end--
+			if end > 0 && line[end-1] == '\r' {
 				end--
 			}
-			if end > 0 {
-				fn(line[0:end], offset)
-			}
+		}
+		if end > 0 {
+			fn(line[0:end], offset)
 		}
 		offset += int64(len(line))
+		if lines % 1024 == 0 {
+			ws.progress.Store(ws.wordSpliterStats)
+		}
 
 		if err == io.EOF {
 			err = nil
@@ -247,7 +206,18 @@ func (ws *wordSpliteWorker) scanlines(r io.Reader, fn func(line []byte, offset i
 		}
 	}
 }
-func (ws *wordSpliteWorker) Measure(r io.Reader) error {
+// scan calls emit for every entry found in r.
+func (ws *wordSpliteWorker) scan(r io.Reader, emit func(pos int64, length, tag int)) error {
+	if ws.csv != nil {
+		return ws.scanRecords(r, emit)
+	}
+	if ws.json != nil {
+		return ws.scanlines(r, func(line []byte, offset int64) {
+			ws.json.fields(line, func(start, end, tag int) {
+				emit(offset + int64(start), end - start, tag)
+			})
+		})
+	}
 	return ws.scanlines(r, func(line []byte, offset int64) {
 		m := ws.splitFn(line)
 		for i := 1; i < len(m); i+=2 {
@@ -259,38 +229,31 @@ func (ws *wordSpliteWorker) Measure(r io.Reader) error {
 			if count <= 0 {
 				continue
 			}
-			ws.entryCount ++
-			if ws.wordMin == 0 || ws.wordMin > count {
-				ws.wordMin = count
-			}
-			if ws.wordMax < count {
-				ws.wordMax = count
-			}
-			pos := offset + int64(start)
-			if ws.posMin == 0 || ws.posMin > pos {
-				ws.posMin = pos
-			}
-			if ws.posMax < pos {
-				ws.posMax = pos
-			}
+			emit(offset + int64(start), count, 0)
 		}
 	})
 }
-func (ws *wordSpliteWorker) ReadIntoIndex(r io.Reader, index *Index) error {
-	return ws.scanlines(r, func(line []byte, offset int64) {
-		m := ws.splitFn(line)
-		for i := 1; i < len(m); i+=2 {
-			start, end := m[i-1], m[i]
-			if end > len(line) || start > len(line) || start < 0 || end < 0 {
-				continue
-			}
-			count := end - start
-			if count <= 0 {
-				continue
-			}
-			ws.entryCount++
-			index.Push(offset + int64(start), count)
+func (ws *wordSpliteWorker) Measure(r io.Reader) error {
+	return ws.scan(r, func(pos int64, count, tag int) {
+		ws.entryCount ++
+		if ws.wordMin == 0 || ws.wordMin > count {
+			ws.wordMin = count
+		}
+		if ws.wordMax < count {
+			ws.wordMax = count
 		}
+		if ws.posMin == 0 || ws.posMin > pos {
+			ws.posMin = pos
+		}
+		if ws.posMax < pos {
+			ws.posMax = pos
+		}
+	})
+}
+func (ws *wordSpliteWorker) ReadIntoIndex(r io.Reader, index *Index) error {
+	return ws.scan(r, func(pos int64, count, tag int) {
+		ws.entryCount++
+		index.Push(pos, count, tag)
 	})
 }
 
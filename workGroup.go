@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// workGroup runs goroutines until all return, one fails or its context is
+// done; the first error closes Done so the others stop early, and Wait
+// returns it.
+type workGroup struct {
+	wg   sync.WaitGroup
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newWorkGroup(ctx context.Context) *workGroup {
+	g := &workGroup{ done: make(chan struct{}) }
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.Stop(ctx.Err())
+		case <-g.done:
+		}
+	}()
+	return g
+}
+func (g *workGroup) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.Stop(err)
+		}
+	}()
+}
+// Stop cancels the group, keeping the first error.
+func (g *workGroup) Stop(err error) {
+	g.once.Do(func() {
+		g.err = err
+		close(g.done)
+	})
+}
+func (g *workGroup) Done() <-chan struct{} {
+	return g.done
+}
+func (g *workGroup) Stopped() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+// Wait waits for every goroutine and returns the first error.
+func (g *workGroup) Wait() error {
+	g.wg.Wait()
+	g.Stop(nil)
+	return g.err
+}